@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// lbCheckTTL is the time the check of the load balancer is reused by /readyz,
+// not to call the OVH API at each probe.
+const lbCheckTTL = 10 * time.Second
+
+// lbCheck is the last check of the load balancer.
+type lbCheck struct {
+	check models.Check
+	time  time.Time
+	lock  sync.Mutex
+}
+
+// Healthz reports whether the agent is alive. It fails when the agent is
+// wedged: a provider stopped, lost its source or no sync succeeded for longer
+// than MaxSyncAge, a restart being expected to recover it.
+func (a *Api) Healthz(c *gin.Context) {
+	health(c, a.healthChecks())
+}
+
+func (a *Api) healthChecks() []models.Check {
+	return append(a.providerChecks(a.MaxSyncAge), a.syncCheck())
+}
+
+// Readyz reports whether the agent is ready: its providers are connected, a
+// sync succeeded within MaxSyncAge and the load balancer is reachable with
+// valid credentials, checked at most every lbCheckTTL.
+func (a *Api) Readyz(c *gin.Context) {
+	checks := append(a.providerChecks(0), a.syncCheck())
+	if checker, ok := a.LB.(lb.Checker); ok {
+		checks = append(checks, a.lbCheck(checker))
+	}
+	health(c, checks)
+}
+
+func (a *Api) lbCheck(checker lb.Checker) models.Check {
+	last := &a.lastLBCheck
+	last.lock.Lock()
+	defer last.lock.Unlock()
+
+	if time.Since(last.time) < lbCheckTTL {
+		return last.check
+	}
+	last.check = models.Check{Name: "lb", OK: true}
+	if err := checker.Check(); err != nil {
+		last.check.OK = false
+		last.check.Error = err.Error()
+	}
+	last.time = time.Now()
+	return last.check
+}
+
+// providerChecks fails for the stopped providers and the ones disconnected
+// from their source for longer than grace.
+func (a *Api) providerChecks(grace time.Duration) []models.Check {
+	checks := make([]models.Check, len(a.Providers))
+	for i, p := range a.Providers {
+		status := p.Status()
+		checks[i] = models.Check{Name: "provider:" + p.Name(), OK: true}
+		if !status.Connected {
+			checks[i].Error = status.Error
+			checks[i].OK = !status.Stopped && time.Since(status.Since) < grace
+		}
+	}
+	return checks
+}
+
+func (a *Api) syncCheck() models.Check {
+	check := models.Check{Name: "sync", OK: true}
+	if since := a.Syncer.SinceSuccess(); since > a.MaxSyncAge {
+		check.OK = false
+		check.Error = fmt.Sprintf("no successful sync for %s", since.Truncate(time.Second))
+		if status := a.Syncer.Status(); status.Error != "" {
+			check.Error += ": " + status.Error
+		}
+	}
+	return check
+}
+
+func health(c *gin.Context, checks []models.Check) {
+	for _, check := range checks {
+		if !check.OK {
+			c.JSON(503, gin.H{"ok": false, "checks": checks})
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"ok": true, "checks": checks})
+}
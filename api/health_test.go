@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+	"github.com/thbkrkr/iplb-docker/provider"
+)
+
+type statusProvider struct {
+	status provider.Status
+}
+
+func (p *statusProvider) Name() string                                            { return p.status.Provider }
+func (p *statusProvider) List() ([]models.Service, error)                         { return nil, nil }
+func (p *statusProvider) Status() provider.Status                                 { return p.status }
+func (p *statusProvider) Watch(chan<- provider.ServiceSet, <-chan struct{}) error { return nil }
+
+func TestProviderChecks(t *testing.T) {
+	a := &Api{Providers: []provider.Provider{
+		&statusProvider{provider.Status{Provider: "docker", Connected: true, Since: time.Now()}},
+		&statusProvider{provider.Status{Provider: "swarm", Error: "connection refused", Since: time.Now()}},
+		&statusProvider{provider.Status{Provider: "kubernetes", Error: "connection refused", Since: time.Now().Add(-time.Hour)}},
+	}}
+
+	expected := []bool{true, true, false}
+	for i, check := range a.providerChecks(time.Minute) {
+		if check.OK != expected[i] {
+			t.Errorf("expected %s to be ok: %v, got %+v", check.Name, expected[i], check)
+		}
+	}
+}
+
+// failingProvider is connected until its Watch fails with err.
+type failingProvider struct {
+	name string
+	err  error
+}
+
+func (p *failingProvider) Name() string                    { return p.name }
+func (p *failingProvider) List() ([]models.Service, error) { return nil, nil }
+func (p *failingProvider) Status() provider.Status {
+	return provider.Status{Provider: p.name, Connected: true, Since: time.Now()}
+}
+func (p *failingProvider) Watch(chan<- provider.ServiceSet, <-chan struct{}) error { return p.err }
+
+func TestHealthzStoppedProvider(t *testing.T) {
+	docker := provider.Supervise(&failingProvider{name: "docker", err: errors.New("event stream closed")})
+	file := provider.Supervise(&failingProvider{name: "file"})
+	a := &Api{
+		Providers:  []provider.Provider{docker, file},
+		Syncer:     lb.NewSyncer(lb.NewMemory("10.0.0.1", "all"), func() []models.Service { return nil }),
+		MaxSyncAge: time.Minute,
+	}
+
+	for _, check := range a.healthChecks() {
+		if !check.OK {
+			t.Errorf("expected the agent to be healthy, got %+v", check)
+		}
+	}
+
+	sets := make(chan provider.ServiceSet)
+	stop := make(chan struct{})
+	for _, p := range a.Providers {
+		p.Watch(sets, stop)
+	}
+	checks := a.healthChecks()
+	if checks[0].OK || checks[0].Error != "stopped watching: event stream closed" {
+		t.Errorf("expected the stopped docker provider to fail, got %+v", checks[0])
+	}
+	if !checks[1].OK || !checks[2].OK {
+		t.Errorf("expected the file provider and the sync to be healthy, got %+v", checks[1:])
+	}
+}
+
+type countingChecker struct {
+	calls int
+	err   error
+}
+
+func (c *countingChecker) Check() error {
+	c.calls++
+	return c.err
+}
+
+func TestLBCheckCached(t *testing.T) {
+	a := &Api{}
+	checker := &countingChecker{err: errors.New("invalid credentials")}
+
+	for i := 0; i < 3; i++ {
+		if check := a.lbCheck(checker); check.OK || check.Error != "invalid credentials" {
+			t.Errorf("expected the check to fail, got %+v", check)
+		}
+	}
+	if checker.calls != 1 {
+		t.Errorf("expected the load balancer to be checked once, got %d", checker.calls)
+	}
+
+	// Checked again once expired
+	checker.err = nil
+	a.lastLBCheck.time = time.Now().Add(-lbCheckTTL)
+	if check := a.lbCheck(checker); !check.OK || checker.calls != 2 {
+		t.Errorf("expected the load balancer to be checked again, got %+v", check)
+	}
+}
@@ -2,18 +2,88 @@ package api
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	iplbapi "github.com/thbkrkr/iplb-docker/iplb"
+	"github.com/thbkrkr/iplb-docker/lb"
 	"github.com/thbkrkr/iplb-docker/models"
+	"github.com/thbkrkr/iplb-docker/provider"
 )
 
 type Api struct {
-	IPLB *iplbapi.IPLB
+	LB        lb.LoadBalancer
+	Syncer    *lb.Syncer
+	Providers []provider.Provider
+	Registry  *provider.Registry
+	Manual    *provider.Manual
+
+	// MaxSyncAge is the time without successful sync or with a disconnected
+	// provider after which the agent is reported wedged.
+	MaxSyncAge time.Duration
+
+	lastLBCheck lbCheck
+}
+
+// Services returns the services to register, with the provider and
+// container they come from.
+func (a *Api) Services(c *gin.Context) {
+	c.JSON(200, a.Registry.Services())
+}
+
+func (a *Api) SyncStatus(c *gin.Context) {
+	c.JSON(200, a.Syncer.Status())
+}
+
+// Plan returns the changes the next sync would make.
+func (a *Api) Plan(c *gin.Context) {
+	plan, err := a.Syncer.Plan()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, plan)
+}
+
+// Sync syncs the services now and returns its status.
+func (a *Api) Sync(c *gin.Context) {
+	status := a.Syncer.Sync()
+	if status.Error != "" {
+		c.JSON(500, status)
+		return
+	}
+
+	c.JSON(200, status)
+}
+
+// Projects returns the registered services by compose project and backend,
+// the services without project being under an empty one.
+func (a *Api) Projects(c *gin.Context) {
+	projects := map[string]map[string][]models.Service{}
+	for _, service := range a.Registry.Services() {
+		backends, ok := projects[service.Project]
+		if !ok {
+			backends = map[string][]models.Service{}
+			projects[service.Project] = backends
+		}
+		backends[service.Backend] = append(backends[service.Backend], service)
+	}
+
+	c.JSON(200, projects)
+}
+
+func (a *Api) ProviderStatuses(c *gin.Context) {
+	statuses := make([]provider.Status, len(a.Providers))
+	for i, p := range a.Providers {
+		statuses[i] = p.Status()
+		statuses[i].Provider = p.Name()
+	}
+
+	c.JSON(200, statuses)
 }
 
 func (a *Api) Servers(c *gin.Context) {
-	servers, err := a.IPLB.GetServers()
+	servers, err := a.LB.GetServers()
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -23,7 +93,7 @@ func (a *Api) Servers(c *gin.Context) {
 }
 
 func (a *Api) Backends(c *gin.Context) {
-	backends, err := a.IPLB.GetBackends()
+	backends, err := a.LB.GetBackends()
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -33,7 +103,7 @@ func (a *Api) Backends(c *gin.Context) {
 }
 
 func (a *Api) Frontends(c *gin.Context) {
-	frontends, err := a.IPLB.GetFrontends()
+	frontends, err := a.LB.GetFrontends()
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -42,8 +112,18 @@ func (a *Api) Frontends(c *gin.Context) {
 	c.JSON(200, frontends)
 }
 
+func (a *Api) Routes(c *gin.Context) {
+	routes, err := a.LB.GetRoutes()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, routes)
+}
+
 func (a *Api) Links(c *gin.Context) {
-	backends, err := a.IPLB.GetBackends()
+	backends, err := a.LB.GetBackends()
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -59,7 +139,7 @@ func (a *Api) Links(c *gin.Context) {
 		go func(ix int, bid int) {
 			defer wg.Done()
 
-			lks, err := a.IPLB.GetLinksByBackendID(bid)
+			lks, err := a.LB.GetLinksByBackendID(bid)
 			if err != nil {
 				c.JSON(500, gin.H{"error": err.Error()})
 				return
@@ -73,3 +153,63 @@ func (a *Api) Links(c *gin.Context) {
 
 	c.JSON(200, links)
 }
+
+// Manual services
+
+func (a *Api) ManualServices(c *gin.Context) {
+	c.JSON(200, a.Manual.All())
+}
+
+func (a *Api) AddService(c *gin.Context) {
+	var entry provider.ManualService
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err := a.Manual.Add(entry)
+	if err != nil {
+		manualError(c, err)
+		return
+	}
+
+	c.JSON(201, entry)
+}
+
+func (a *Api) UpdateService(c *gin.Context) {
+	var entry provider.ManualService
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err := a.Manual.Update(c.Param("id"), entry)
+	if err != nil {
+		manualError(c, err)
+		return
+	}
+
+	c.JSON(200, entry)
+}
+
+func (a *Api) DeleteService(c *gin.Context) {
+	if err := a.Manual.Delete(c.Param("id")); err != nil {
+		manualError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+func manualError(c *gin.Context, err error) {
+	switch err.(type) {
+	case *provider.InvalidServiceError:
+		c.JSON(400, gin.H{"error": err.Error()})
+	default:
+		if err == provider.ErrNotFound {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+	}
+}
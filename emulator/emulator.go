@@ -0,0 +1,469 @@
+package emulator
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const zone = "local"
+
+// Emulator is a load balancer target proxying the requests itself, like the
+// IPLB would, to try the frontends, host rules and weights of the services
+// locally. Each frontend port gets its own listener, routing the HTTP
+// requests by host or proxying the TCP connections to the default backend of
+// the frontend.
+type Emulator struct {
+	*lb.Memory
+
+	// Listen is the host of the listeners, all interfaces when empty.
+	Listen string
+	// CertFile and KeyFile serve the SSL frontends, skipped without them.
+	CertFile string
+	KeyFile  string
+
+	mu        sync.Mutex
+	listeners map[string]*listener
+}
+
+// listener serves the routes of a frontend port by host, or proxies its
+// connections to the route of a TCP frontend.
+type listener struct {
+	server *http.Server
+	tcp    net.Listener
+
+	mu     sync.RWMutex
+	routes map[string]*route
+	route  *route
+}
+
+// close stops the listener and closes the idle connections of its links.
+func (l *listener) close() {
+	if l.tcp != nil {
+		l.tcp.Close()
+	} else {
+		l.server.Close()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rt := range l.routes {
+		rt.update(&route{})
+	}
+	if l.route != nil {
+		l.route.update(&route{})
+	}
+}
+
+// update takes the routes of a frontend built from the state. The routes of
+// the hosts already served are updated in place, keeping their links.
+func (l *listener) update(frontend *frontend) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	routes := map[string]*route{}
+	for host, from := range frontend.routes {
+		rt, ok := l.routes[host]
+		if !ok {
+			rt = &route{}
+		}
+		rt.update(from)
+		routes[host] = rt
+	}
+	for host, rt := range l.routes {
+		if _, ok := routes[host]; !ok {
+			rt.update(&route{})
+		}
+	}
+	l.routes = routes
+
+	if frontend.tcp != nil {
+		if l.route == nil {
+			l.route = &route{}
+		}
+		l.route.update(frontend.tcp)
+	}
+}
+
+func NewEmulator(address string, listen string, certFile string, keyFile string) *Emulator {
+	return &Emulator{
+		Memory:    lb.NewMemory(address, zone),
+		Listen:    listen,
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+		listeners: map[string]*listener{},
+	}
+}
+
+// Apply makes the changes of a plan in the state, then updates the routes of
+// the listeners, starting and stopping them as frontend ports come and go. A
+// frontend failing to listen is returned, to be started again by the next
+// Apply.
+func (e *Emulator) Apply(plan *models.Plan) error {
+	err := e.Memory.Apply(plan)
+	if err != nil {
+		return err
+	}
+
+	state, err := e.Snapshot()
+	if err != nil {
+		return err
+	}
+	ports, err := routes(state)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for port, l := range e.listeners {
+		if frontend, ok := ports[port]; !ok || (frontend.tcp != nil) != (l.tcp != nil) {
+			logrus.WithField("port", port).Info("Stop emulated frontend")
+			l.close()
+			delete(e.listeners, port)
+		}
+	}
+
+	var listenErr error
+	for port, frontend := range ports {
+		l, ok := e.listeners[port]
+		if !ok {
+			l, err = e.listen(port, frontend.ssl, frontend.tcp != nil)
+			if err != nil {
+				listenErr = fmt.Errorf("fail to emulate frontend %s: %s", port, err)
+				continue
+			}
+			e.listeners[port] = l
+		}
+		l.update(frontend)
+	}
+
+	return listenErr
+}
+
+func (e *Emulator) listen(port string, ssl bool, tcp bool) (*listener, error) {
+	if ssl && (e.CertFile == "" || e.KeyFile == "") {
+		return nil, fmt.Errorf("a certificate and its key are required by SSL frontends")
+	}
+
+	l := &listener{routes: map[string]*route{}}
+	l.server = &http.Server{Addr: net.JoinHostPort(e.Listen, port), Handler: l}
+
+	ln, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcp {
+		if ssl {
+			cert, err := tls.LoadX509KeyPair(e.CertFile, e.KeyFile)
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+			ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+		l.tcp = ln
+		logrus.WithField("address", l.server.Addr).WithField("ssl", ssl).Info("Emulate TCP frontend")
+		go l.serveTCP()
+		return l, nil
+	}
+
+	logrus.WithField("address", l.server.Addr).WithField("ssl", ssl).Info("Emulate frontend")
+	go func() {
+		var err error
+		if ssl {
+			err = l.server.ServeTLS(ln, e.CertFile, e.KeyFile)
+		} else {
+			err = l.server.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			logrus.WithError(err).WithField("address", l.server.Addr).Error("Emulated frontend stopped")
+		}
+	}()
+
+	return l, nil
+}
+
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	l.mu.RLock()
+	rt, ok := l.routes[strings.ToLower(host)]
+	l.mu.RUnlock()
+	if !ok {
+		http.Error(w, "no frontend for host "+host, http.StatusNotFound)
+		return
+	}
+
+	rt.ServeHTTP(w, r)
+}
+
+// frontend is the routes of a port by host, or the route of its default
+// backend for a TCP frontend, their links being without proxy until given to
+// a listener.
+type frontend struct {
+	ssl    bool
+	routes map[string]*route
+	tcp    *route
+}
+
+func routes(state *models.State) (map[string]*frontend, error) {
+	servers := map[int]models.Server{}
+	for _, s := range state.Servers {
+		servers[s.ID] = s
+	}
+	backends := map[int]models.Backend{}
+	for _, b := range state.Backends {
+		backends[b.ID] = b
+	}
+	frontends := map[int]models.Frontend{}
+	for _, f := range state.Frontends {
+		frontends[f.ID] = f
+	}
+
+	addLinks := func(rt *route, backendID int) {
+		for _, l := range state.Links[backendID] {
+			if s, ok := servers[l.ServerID]; ok {
+				rt.addLink(s.Address, l)
+			}
+		}
+	}
+
+	ports := map[string]*frontend{}
+	for _, f := range state.Frontends {
+		b, ok := backends[f.DefaultBackendID]
+		if !ok || b.Type != lb.TypeTCP {
+			continue
+		}
+		rt, err := newRoute(b.Name, f.AllowedSource, nil)
+		if err != nil {
+			return nil, err
+		}
+		addLinks(rt, b.ID)
+		ports[f.Port] = &frontend{ssl: f.SSL, tcp: rt}
+	}
+
+	for i := range state.Routes {
+		r := &state.Routes[i]
+		f, ok := frontends[r.FrontendID]
+		b, found := backends[r.BackendID]
+		host := lb.RouteHost(r)
+		if !ok || !found || host == "" {
+			continue
+		}
+
+		rt, err := newRoute(b.Name, f.AllowedSource, f.HTTPHeader)
+		if err != nil {
+			return nil, err
+		}
+		addLinks(rt, b.ID)
+
+		fr, ok := ports[f.Port]
+		if ok && fr.tcp != nil {
+			continue
+		}
+		if !ok {
+			fr = &frontend{ssl: f.SSL, routes: map[string]*route{}}
+			ports[f.Port] = fr
+		}
+		fr.routes[strings.ToLower(host)] = rt
+	}
+
+	return ports, nil
+}
+
+// route proxies the requests of a host to the links of its backend, picked by
+// smooth weighted round robin, the backup links being used only when there
+// is no other one.
+type route struct {
+	backend string
+	allowed []*net.IPNet
+	headers http.Header
+
+	mu      sync.Mutex
+	links   []*link
+	backups []*link
+}
+
+type link struct {
+	proxy   *httputil.ReverseProxy
+	address string
+	ssl     bool
+	weight  int
+	current int
+}
+
+// target identifies the links proxying to the same address.
+func (lk *link) target() string {
+	if lk.ssl {
+		return "https://" + lk.address
+	}
+	return "http://" + lk.address
+}
+
+// close closes the idle connections of the transport of an SSL link.
+func (lk *link) close() {
+	if t, ok := lk.proxy.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+func newRoute(backend string, allowedSource []string, httpHeader []string) (*route, error) {
+	rt := &route{backend: backend, headers: http.Header{}}
+	for _, source := range allowedSource {
+		if !strings.Contains(source, "/") {
+			if strings.Contains(source, ":") {
+				source += "/128"
+			} else {
+				source += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, err
+		}
+		rt.allowed = append(rt.allowed, network)
+	}
+	for _, header := range httpHeader {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) == 2 {
+			rt.headers.Set(parts[0], strings.TrimSpace(parts[1]))
+		}
+	}
+	return rt, nil
+}
+
+func (rt *route) addLink(address string, l models.Link) {
+	lk := &link{address: net.JoinHostPort(address, fmt.Sprint(l.Port)), ssl: l.SSL, weight: l.Weight}
+	if l.Backup {
+		rt.backups = append(rt.backups, lk)
+	} else {
+		rt.links = append(rt.links, lk)
+	}
+}
+
+// update takes the backend, sources, headers and links of a route built from
+// the state. The links to the same targets are kept, with their proxy and
+// round robin state, and the idle connections of the others are closed.
+func (rt *route) update(from *route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	links := map[string]*link{}
+	for _, lk := range append(rt.links, rt.backups...) {
+		links[lk.target()] = lk
+	}
+	keep := func(from []*link) []*link {
+		kept := []*link{}
+		for _, lk := range from {
+			if old, ok := links[lk.target()]; ok {
+				delete(links, lk.target())
+				old.weight = lk.weight
+				lk = old
+			} else {
+				lk.proxy = newProxy(lk)
+			}
+			kept = append(kept, lk)
+		}
+		return kept
+	}
+
+	rt.backend, rt.allowed, rt.headers = from.backend, from.allowed, from.headers
+	rt.links = keep(from.links)
+	rt.backups = keep(from.backups)
+	for _, lk := range links {
+		lk.close()
+	}
+}
+
+func newProxy(lk *link) *httputil.ReverseProxy {
+	target := &url.URL{Scheme: "http", Host: lk.address}
+	if lk.ssl {
+		target.Scheme = "https"
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if lk.ssl {
+		proxy.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return proxy
+}
+
+// options returns the backend, sources and headers of the route, replaced by
+// the updates.
+func (rt *route) options() (string, []*net.IPNet, http.Header) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.backend, rt.allowed, rt.headers
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend, allowed, headers := rt.options()
+	if len(allowed) > 0 && !allows(allowed, r.RemoteAddr) {
+		http.Error(w, "forbidden source", http.StatusForbidden)
+		return
+	}
+
+	lk := rt.next()
+	if lk == nil {
+		http.Error(w, "no link in backend "+backend, http.StatusServiceUnavailable)
+		return
+	}
+
+	for name, values := range headers {
+		r.Header[name] = values
+	}
+	lk.proxy.ServeHTTP(w, r)
+}
+
+func allows(allowed []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range allowed {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *route) next() *link {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	links := rt.links
+	if len(links) == 0 {
+		links = rt.backups
+	}
+
+	var best *link
+	total := 0
+	for _, lk := range links {
+		lk.current += lk.weight
+		total += lk.weight
+		if best == nil || lk.current > best.current {
+			best = lk
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
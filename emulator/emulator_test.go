@@ -0,0 +1,215 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// freePort returns a port free to listen on.
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// upstream starts an HTTP server answering its name, returning its port.
+func upstream(t *testing.T, name string) int {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func newEmulator(t *testing.T) *Emulator {
+	e := NewEmulator("127.0.0.1", "127.0.0.1", "", "")
+	t.Cleanup(func() { apply(t, e, nil) })
+	return e
+}
+
+func apply(t *testing.T, e *Emulator, services []models.Service) {
+	state, err := e.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Apply(e.Plan(state, services)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the body of a request to a host through a frontend port.
+func get(t *testing.T, port int, host string) (int, string) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHostRoutingAndWeights(t *testing.T) {
+	e := newEmulator(t)
+	frontendPort := freePort(t)
+	services := []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: upstream(t, "bim-1"), Weight: 3, FrontendPort: frontendPort},
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: upstream(t, "bim-2"), Weight: 1, FrontendPort: frontendPort},
+		{Frontend: "bam.example.com", Backend: "app_bam", Port: upstream(t, "bam"), Weight: 100, FrontendPort: frontendPort},
+	}
+	apply(t, e, services)
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		status, body := get(t, frontendPort, "BIM.example.com")
+		if status != http.StatusOK {
+			t.Fatalf("expected bim to answer, got %d %s", status, body)
+		}
+		counts[body]++
+	}
+	if counts["bim-1"] != 6 || counts["bim-2"] != 2 {
+		t.Errorf("expected the requests to be shared 3 to 1, got %v", counts)
+	}
+
+	if _, body := get(t, frontendPort, "bam.example.com:80"); body != "bam" {
+		t.Errorf("expected bam to answer, got %s", body)
+	}
+	if status, _ := get(t, frontendPort, "unknown.example.com"); status != http.StatusNotFound {
+		t.Errorf("expected an unknown host to be refused, got %d", status)
+	}
+
+	// The link of a stopped service is removed
+	apply(t, e, []models.Service{services[0], services[2]})
+	for i := 0; i < 4; i++ {
+		if _, body := get(t, frontendPort, "bim.example.com"); body != "bim-1" {
+			t.Errorf("expected only bim-1 to answer, got %s", body)
+		}
+	}
+}
+
+func TestTCPProxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprint(conn, "echo "+line)
+			}()
+		}
+	}()
+
+	e := newEmulator(t)
+	frontendPort := freePort(t)
+	apply(t, e, []models.Service{
+		{Backend: "app_db", Type: "tcp", Port: echo.Addr().(*net.TCPAddr).Port, Weight: 100, FrontendPort: frontendPort},
+	})
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", frontendPort), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "echo ping\n" {
+		t.Errorf("expected the echo server to answer, got %q", line)
+	}
+}
+
+func TestLinksKept(t *testing.T) {
+	e := newEmulator(t)
+	frontendPort := freePort(t)
+	services := []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: upstream(t, "bim-1"), Weight: 3, FrontendPort: frontendPort},
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: upstream(t, "bim-2"), Weight: 1, FrontendPort: frontendPort},
+	}
+	apply(t, e, services)
+	proxy := e.listeners[strconv.Itoa(frontendPort)].routes["bim.example.com"].links[0].proxy
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		// A sync in the middle of the rotation keeps it
+		if i == 2 {
+			apply(t, e, append(services, models.Service{Frontend: "bam.example.com", Backend: "app_bam", Port: upstream(t, "bam"),
+				Weight: 100, FrontendPort: frontendPort}))
+		}
+		_, body := get(t, frontendPort, "bim.example.com")
+		counts[body]++
+	}
+	if counts["bim-1"] != 6 || counts["bim-2"] != 2 {
+		t.Errorf("expected the requests to be shared 3 to 1, got %v", counts)
+	}
+	if e.listeners[strconv.Itoa(frontendPort)].routes["bim.example.com"].links[0].proxy != proxy {
+		t.Errorf("expected the proxy of the link to be kept")
+	}
+}
+
+func TestListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontendPort := busy.Addr().(*net.TCPAddr).Port
+
+	e := newEmulator(t)
+	services := []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: upstream(t, "bim"), Weight: 100, FrontendPort: frontendPort},
+	}
+	state, err := e.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Apply(e.Plan(state, services)); err == nil {
+		t.Errorf("expected the busy frontend port to fail")
+	}
+
+	// Listening at the next sync once the port is free
+	busy.Close()
+	apply(t, e, services)
+	if _, body := get(t, frontendPort, "bim.example.com"); body != "bim" {
+		t.Errorf("expected bim to answer, got %s", body)
+	}
+}
@@ -0,0 +1,75 @@
+package emulator
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const dialTimeout = 5 * time.Second
+
+// serveTCP proxies the connections of a TCP frontend until its listener is
+// closed.
+func (l *listener) serveTCP() {
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		l.mu.RLock()
+		rt := l.route
+		l.mu.RUnlock()
+		go rt.serveTCP(conn)
+	}
+}
+
+// serveTCP proxies a connection to the next link of the route.
+func (rt *route) serveTCP(conn net.Conn) {
+	defer conn.Close()
+
+	backend, allowed, _ := rt.options()
+	if len(allowed) > 0 && !allows(allowed, conn.RemoteAddr().String()) {
+		return
+	}
+
+	lk := rt.next()
+	if lk == nil {
+		logrus.WithField("backend", backend).Error("Fail to proxy connection: no link in backend")
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var upstream net.Conn
+	var err error
+	if lk.ssl {
+		upstream, err = tls.DialWithDialer(dialer, "tcp", lk.address, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		upstream, err = dialer.Dial("tcp", lk.address)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("backend", backend).Error("Fail to proxy connection")
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		// Let the other side finish its writes
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	<-done
+}
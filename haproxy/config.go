@@ -0,0 +1,253 @@
+package haproxy
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// config is the haproxy.cfg of a state: each IPLB frontend becomes an HAProxy
+// frontend choosing the backend of its routes by host, or proxying the
+// connections to its default backend in TCP mode. CAFiles are the
+// contents of the CA chains of the links by path, to write beside it.
+type config struct {
+	Frontends []frontend
+	Backends  []backend
+	CAFiles   map[string]string
+}
+
+type frontend struct {
+	Name           string
+	Port           string
+	TCP            bool
+	DefaultBackend string
+	SSL            bool
+	CertPath       string
+	AllowedSource  []string
+	Headers        []header
+	Routes         []route
+}
+
+type route struct {
+	ACL     string
+	Host    string
+	Backend string
+}
+
+type header struct {
+	Name  string
+	Value string
+}
+
+type backend struct {
+	Name    string
+	TCP     bool
+	Probe   *models.Probe
+	Cookie  bool
+	Servers []server
+}
+
+type server struct {
+	Name          string
+	Address       string
+	Port          int
+	Weight        int
+	Backup        bool
+	Check         bool
+	SSL           bool
+	CAFile        string
+	ProxyProtocol string
+	Cookie        string
+}
+
+// caFilePrefix names the CA files written beside the configuration.
+const caFilePrefix = "iplb-ca-"
+
+var proxyProtocols = map[string]string{
+	"v1":        "send-proxy",
+	"v2":        "send-proxy-v2",
+	"v2-ssl":    "send-proxy-v2-ssl",
+	"v2-ssl-cn": "send-proxy-v2-ssl-cn",
+}
+
+// newConfig returns the configuration of a state, the CA files being in dir.
+// The SSL frontends are skipped without certificate.
+func newConfig(state *models.State, certPath string, dir string) config {
+	servers := map[int]models.Server{}
+	for _, s := range state.Servers {
+		servers[s.ID] = s
+	}
+	backends := map[int]models.Backend{}
+	for _, b := range state.Backends {
+		backends[b.ID] = b
+	}
+
+	cfg := config{CAFiles: map[string]string{}}
+	for _, f := range state.Frontends {
+		if f.SSL && certPath == "" {
+			logrus.WithField("port", f.Port).Error("Skip SSL frontend without HAProxy certificate")
+			continue
+		}
+		name := "http-" + f.Port
+		if f.SSL {
+			name = "https-" + f.Port
+		}
+		fr := frontend{Name: name, Port: f.Port, SSL: f.SSL, CertPath: certPath, AllowedSource: f.AllowedSource}
+		if b, ok := backends[f.DefaultBackendID]; ok && b.Type == lb.TypeTCP {
+			fr.Name = "tcp-" + f.Port
+			fr.TCP = true
+			fr.DefaultBackend = b.Name
+			cfg.Frontends = append(cfg.Frontends, fr)
+			continue
+		}
+		for _, h := range f.HTTPHeader {
+			parts := strings.SplitN(h, ":", 2)
+			if len(parts) == 2 {
+				fr.Headers = append(fr.Headers, header{Name: parts[0], Value: strings.TrimSpace(parts[1])})
+			}
+		}
+
+		for i := range state.Routes {
+			r := &state.Routes[i]
+			b, ok := backends[r.BackendID]
+			host := lb.RouteHost(r)
+			if r.FrontendID != f.ID || !ok || host == "" {
+				continue
+			}
+			fr.Routes = append(fr.Routes, route{ACL: fmt.Sprintf("host_%d", r.ID), Host: host, Backend: b.Name})
+		}
+		sort.Slice(fr.Routes, func(i, j int) bool { return fr.Routes[i].Host < fr.Routes[j].Host })
+		cfg.Frontends = append(cfg.Frontends, fr)
+	}
+	sort.Slice(cfg.Frontends, func(i, j int) bool { return cfg.Frontends[i].Name < cfg.Frontends[j].Name })
+
+	for _, b := range state.Backends {
+		be := backend{Name: b.Name, TCP: b.Type == lb.TypeTCP, Probe: b.Probe}
+		for _, l := range state.Links[b.ID] {
+			s, ok := servers[l.ServerID]
+			if !ok {
+				continue
+			}
+			sv := server{
+				Name:          fmt.Sprintf("server_%d", l.ID),
+				Address:       s.Address,
+				Port:          l.Port,
+				Weight:        l.Weight,
+				Backup:        l.Backup,
+				Check:         l.Probe,
+				SSL:           l.SSL,
+				ProxyProtocol: proxyProtocols[l.ProxyProtocolVersion],
+				Cookie:        l.Cookie,
+			}
+			if l.SSL && l.Chain != "" {
+				sv.CAFile = filepath.Join(dir, fmt.Sprintf("%s%x.pem", caFilePrefix, sha1.Sum([]byte(l.Chain))))
+				cfg.CAFiles[sv.CAFile] = l.Chain
+			}
+			be.Cookie = be.Cookie || l.Cookie != ""
+			be.Servers = append(be.Servers, sv)
+		}
+		cfg.Backends = append(cfg.Backends, be)
+	}
+	sort.Slice(cfg.Backends, func(i, j int) bool { return cfg.Backends[i].Name < cfg.Backends[j].Name })
+
+	return cfg
+}
+
+// quote returns a value between single quotes, in which HAProxy reads every
+// character as is but the quote itself, closed around an escaped one.
+func quote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// word returns a value as a single word of the configuration, quoted when it
+// contains spaces or characters HAProxy interprets.
+func word(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t'\"\\#$") {
+		return quote(value)
+	}
+	return value
+}
+
+// logFormat escapes the % of a value used as a log-format string.
+func logFormat(value string) string {
+	return strings.Replace(value, "%", "%%", -1)
+}
+
+var funcs = template.FuncMap{"quote": quote, "word": word, "logFormat": logFormat}
+
+var configTemplate = template.Must(template.New("haproxy.cfg").Funcs(funcs).Parse(`# Generated by iplb-docker, do not edit.
+
+global
+    maxconn 4096
+
+defaults
+    mode http
+    option forwardfor
+    timeout connect 5s
+    timeout client 50s
+    timeout server 50s
+{{range .Frontends}}
+frontend {{.Name}}
+    bind *:{{.Port}}{{if .SSL}} ssl crt {{word .CertPath}}{{end}}
+{{- if .TCP}}
+    mode tcp
+{{- if .AllowedSource}}
+    tcp-request connection reject if !{ src {{range $i, $s := .AllowedSource}}{{if $i}} {{end}}{{$s}}{{end}} }
+{{- end}}
+    default_backend {{word .DefaultBackend}}
+{{- else}}
+{{- if .AllowedSource}}
+    http-request deny if !{ src {{range $i, $s := .AllowedSource}}{{if $i}} {{end}}{{$s}}{{end}} }
+{{- end}}
+{{- range .Headers}}
+    http-request set-header {{word .Name}} {{quote (logFormat .Value)}}
+{{- end}}
+{{- range .Routes}}
+    acl {{.ACL}} hdr(host),field(1,:) -i {{word .Host}}
+    use_backend {{word .Backend}} if {{.ACL}}
+{{- end}}
+{{- end}}
+{{end}}
+{{- range .Backends}}
+backend {{word .Name}}
+{{- if .TCP}}
+    mode tcp
+{{- end}}
+{{- if .Cookie}}
+    cookie SERVERID insert indirect nocache
+{{- end}}
+{{- with .Probe}}
+{{- if eq .Type "http"}}
+    option httpchk {{if .Method}}{{word .Method}}{{else}}GET{{end}} {{if .URL}}{{word .URL}}{{else}}/{{end}}
+{{- if eq .Match "status"}}
+    http-check expect {{if .Negate}}! {{end}}status {{word .Pattern}}
+{{- else if eq .Match "matches"}}
+    http-check expect {{if .Negate}}! {{end}}rstring {{quote .Pattern}}
+{{- end}}
+{{- else if eq .Type "smtp"}}
+    option smtpchk
+{{- else if eq .Type "mysql"}}
+    option mysql-check
+{{- else if eq .Type "pgsql"}}
+    option pgsql-check
+{{- end}}
+{{- if .Interval}}
+    default-server inter {{.Interval}}s
+{{- end}}
+{{- end}}
+{{- range .Servers}}
+    server {{.Name}} {{word (printf "%s:%d" .Address .Port)}} weight {{.Weight}}
+{{- if .Backup}} backup{{end}}
+{{- if .Check}} check{{end}}
+{{- if .SSL}} ssl{{if .CAFile}} verify required ca-file {{word .CAFile}}{{else}} verify none{{end}}{{end}}
+{{- with .ProxyProtocol}} {{.}}{{end}}
+{{- with .Cookie}} cookie {{word .}}{{end}}
+{{- end}}
+{{end}}`))
@@ -0,0 +1,174 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const zone = "local"
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// HAProxy is a load balancer target rendering the services in a haproxy.cfg
+// file, like the IPLB does, and reloading HAProxy when it changes. Its state
+// is kept in memory, the whole file being rendered again at each start.
+type HAProxy struct {
+	*lb.Memory
+
+	// Path of the rendered haproxy.cfg.
+	Path string
+	// CertPath is given to the binds of the SSL frontends, a PEM file or a
+	// directory of PEM files. The SSL frontends are skipped without it.
+	CertPath string
+	// ReloadCommand is run by sh after each rendering when set, otherwise
+	// ReloadSignal is sent to the process of PidFile.
+	ReloadCommand string
+	PidFile       string
+	ReloadSignal  syscall.Signal
+
+	mu       sync.Mutex
+	rendered []byte
+}
+
+func NewHAProxy(path string, address string, certPath string, reloadCommand string, pidFile string, reloadSignal string) (*HAProxy, error) {
+	signal, ok := signals[strings.TrimPrefix(strings.ToUpper(reloadSignal), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("invalid reload signal %s, expected HUP, USR1 or USR2", reloadSignal)
+	}
+
+	if certPath != "" {
+		if _, err := os.Stat(certPath); err != nil {
+			return nil, fmt.Errorf("invalid HAProxy certificate path: %s", err)
+		}
+	}
+
+	return &HAProxy{
+		Memory:        lb.NewMemory(address, zone),
+		Path:          path,
+		CertPath:      certPath,
+		ReloadCommand: reloadCommand,
+		PidFile:       pidFile,
+		ReloadSignal:  signal,
+	}, nil
+}
+
+// Apply makes the changes of a plan in the state, then renders and reloads
+// the configuration when it differs from the last one.
+func (h *HAProxy) Apply(plan *models.Plan) error {
+	err := h.Memory.Apply(plan)
+	if err != nil {
+		return err
+	}
+
+	return h.render()
+}
+
+// render writes the configuration and its CA files through temporary files
+// and reloads HAProxy, unless it is unchanged since the last successful
+// reload. The CA files no longer used are removed.
+func (h *HAProxy) render() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, err := h.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(h.Path)
+	config := newConfig(state, h.CertPath, dir)
+	var cfg bytes.Buffer
+	err = configTemplate.Execute(&cfg, config)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(cfg.Bytes(), h.rendered) {
+		return nil
+	}
+
+	for path, chain := range config.CAFiles {
+		if err := writeFile(path, []byte(chain)); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(h.Path, cfg.Bytes()); err != nil {
+		return err
+	}
+
+	caFiles, err := filepath.Glob(filepath.Join(dir, caFilePrefix+"*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, path := range caFiles {
+		if _, ok := config.CAFiles[path]; !ok {
+			os.Remove(path)
+		}
+	}
+
+	logrus.WithField("path", h.Path).Info("HAProxy configuration rendered")
+	if err := h.reload(); err != nil {
+		return err
+	}
+	h.rendered = cfg.Bytes()
+	return nil
+}
+
+// writeFile replaces a file through a temporary file, for HAProxy to never
+// read a partial one.
+func writeFile(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (h *HAProxy) reload() error {
+	if h.ReloadCommand != "" {
+		output, err := exec.Command("sh", "-c", h.ReloadCommand).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("fail to reload HAProxy: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	if h.PidFile == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(h.PidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("invalid HAProxy pid file %s: %s", h.PidFile, err)
+	}
+
+	return syscall.Kill(pid, h.ReloadSignal)
+}
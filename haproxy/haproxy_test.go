@@ -0,0 +1,230 @@
+package haproxy
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+var update = flag.Bool("update", false, "write the golden files of the rendered configurations")
+
+const chain = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func httpServices() []models.Service {
+	probe := &models.Probe{Type: "http", URL: "/health", Match: "status", Pattern: "200", Interval: 5}
+	return []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: 32768, Weight: 100, FrontendPort: 80, Probe: probe},
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: 32769, Weight: 50, Backup: true, FrontendPort: 80, Probe: probe},
+		{Frontend: "bam.example.com", Backend: "app_bam", Address: "10.0.0.2", Port: 8080, Weight: 100, FrontendPort: 80},
+		{Frontend: "api.example.com", Backend: "app_api", Address: "10.0.0.2", Port: 8081, Weight: 100, FrontendPort: 8080,
+			AllowedSource: []string{"10.0.0.0/8", "192.168.0.1"}, HTTPHeader: []string{"X-Forwarded-Port: 8080"}},
+	}
+}
+
+func sslServices() []models.Service {
+	return []models.Service{
+		{Frontend: "shop.example.com", Backend: "app_shop", Port: 8443, Weight: 100, FrontendPort: 443, FrontendSSL: true,
+			SSL: true, Chain: chain, Cookie: "shop-1", ProxyProtocol: "v2"},
+		{Frontend: "shop.example.com", Backend: "app_shop", Address: "10.0.0.2", Port: 8443, Weight: 100, FrontendPort: 443, FrontendSSL: true,
+			SSL: true, Cookie: "shop-2"},
+	}
+}
+
+func tcpServices() []models.Service {
+	return []models.Service{
+		{Backend: "app_db", Type: "tcp", Port: 5432, Weight: 100, FrontendPort: 5432, AllowedSource: []string{"10.0.0.0/8"},
+			Probe: &models.Probe{Type: "tcp"}},
+		{Backend: "app_db", Type: "tcp", Address: "10.0.0.2", Port: 5432, Weight: 100, FrontendPort: 5432, AllowedSource: []string{"10.0.0.0/8"},
+			Probe: &models.Probe{Type: "tcp"}},
+	}
+}
+
+// hostileServices have labels with spaces, quotes and characters HAProxy
+// interprets, to be quoted.
+func hostileServices() []models.Service {
+	probe := &models.Probe{Type: "http", Method: "GET", URL: "/health check#", Match: "matches", Pattern: `^ok '\d+'$`}
+	return []models.Service{
+		{Frontend: "it's.example.com", Backend: "app evil#1", Port: 8080, Weight: 100, FrontendPort: 80, Probe: probe,
+			HTTPHeader: []string{`X-Evil: "%[src]" $HOME \`}, Cookie: "a b"},
+	}
+}
+
+// newHAProxy returns a target rendering in a temporary directory, with a
+// certificate when withCert.
+func newHAProxy(t *testing.T, withCert bool) (*HAProxy, string) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	certPath := ""
+	if withCert {
+		certPath = filepath.Join(dir, "cert.pem")
+		if err := ioutil.WriteFile(certPath, []byte("cert"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := NewHAProxy(filepath.Join(dir, "haproxy.cfg"), "10.0.0.1", certPath, "", "", "USR2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, dir
+}
+
+func apply(t *testing.T, h *HAProxy, services []models.Service) {
+	state, err := h.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Apply(h.Plan(state, services)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rendered returns the configuration, its directory being replaced by
+// /etc/haproxy.
+func rendered(t *testing.T, h *HAProxy, dir string) string {
+	content, err := ioutil.ReadFile(h.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(string(content), dir, "/etc/haproxy", -1)
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		withCert bool
+		services []models.Service
+	}{
+		{"http", false, httpServices()},
+		{"ssl", true, sslServices()},
+		{"ssl-without-cert", false, sslServices()},
+		{"tcp", false, tcpServices()},
+		{"hostile", false, hostileServices()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, dir := newHAProxy(t, test.withCert)
+			apply(t, h, test.services)
+
+			golden := filepath.Join("testdata", test.name+".cfg")
+			cfg := rendered(t, h, dir)
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(cfg), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg != string(expected) {
+				t.Errorf("expected %s, got:\n%s", golden, cfg)
+			}
+		})
+	}
+}
+
+func TestRenderCAFiles(t *testing.T) {
+	h, dir := newHAProxy(t, true)
+	apply(t, h, sslServices())
+
+	caFiles, err := filepath.Glob(filepath.Join(dir, caFilePrefix+"*.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caFiles) != 1 {
+		t.Fatalf("expected 1 CA file, got %v", caFiles)
+	}
+	content, err := ioutil.ReadFile(caFiles[0])
+	if err != nil || string(content) != chain {
+		t.Errorf("expected the CA chain in %s, got %q and %v", caFiles[0], content, err)
+	}
+	if !strings.Contains(rendered(t, h, dir), "ca-file "+strings.Replace(caFiles[0], dir, "/etc/haproxy", 1)) {
+		t.Errorf("expected the configuration to use %s", caFiles[0])
+	}
+
+	// The CA file is removed with its link
+	apply(t, h, sslServices()[1:])
+	caFiles, err = filepath.Glob(filepath.Join(dir, caFilePrefix+"*.pem"))
+	if err != nil || len(caFiles) != 0 {
+		t.Errorf("expected the CA file to be removed, got %v and %v", caFiles, err)
+	}
+}
+
+func TestRenderRemovesServices(t *testing.T) {
+	h, dir := newHAProxy(t, false)
+	apply(t, h, httpServices())
+
+	// app_bam and api are gone, and bim lost its backup link
+	apply(t, h, httpServices()[:1])
+	cfg := rendered(t, h, dir)
+	for _, removed := range []string{"app_bam", "app_api", "bam.example.com", "frontend http-8080", "10.0.0.2", "backup"} {
+		if strings.Contains(cfg, removed) {
+			t.Errorf("expected %s to be removed, got:\n%s", removed, cfg)
+		}
+	}
+	if !strings.Contains(cfg, "use_backend app_bim") {
+		t.Errorf("expected app_bim to be kept, got:\n%s", cfg)
+	}
+
+	state, err := h.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Servers) != 1 || len(state.Backends) != 1 || len(state.Frontends) != 1 || len(state.Routes) != 1 {
+		t.Errorf("expected a single server, backend, frontend and route, got %+v", state)
+	}
+}
+
+func TestReloadRetried(t *testing.T) {
+	h, dir := newHAProxy(t, false)
+	reloads := filepath.Join(dir, "reloads")
+	ready := filepath.Join(dir, "ready")
+	h.ReloadCommand = fmt.Sprintf("echo >> %s && test -f %s", reloads, ready)
+
+	reload := func() error {
+		state, err := h.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.Apply(h.Plan(state, httpServices()))
+	}
+	count := func() int {
+		content, _ := ioutil.ReadFile(reloads)
+		return len(content)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := reload(); err == nil || count() != i {
+			t.Errorf("expected reload %d to fail, got %v after %d reloads", i, err, count())
+		}
+	}
+
+	// Reloaded once more when HAProxy is back, then left alone
+	if err := ioutil.WriteFile(ready, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := reload(); err != nil || count() != 3 {
+			t.Errorf("expected a single successful reload, got %v after %d reloads", err, count())
+		}
+	}
+}
+
+func TestNewHAProxyCertPath(t *testing.T) {
+	_, err := NewHAProxy("haproxy.cfg", "10.0.0.1", "/nonexistent/cert.pem", "", "", "USR2")
+	if err == nil || !strings.Contains(err.Error(), "invalid HAProxy certificate path") {
+		t.Errorf("expected a missing certificate to be refused, got %v", err)
+	}
+}
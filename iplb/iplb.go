@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/ovh/go-ovh/ovh"
+	"github.com/thbkrkr/iplb-docker/lb"
 	"github.com/thbkrkr/iplb-docker/models"
 )
 
@@ -47,95 +49,221 @@ func NewIPLB(endpoint string, ak string, as string, ck string, serviceName strin
 	return &iplbClient, nil
 }
 
-func (i *IPLB) Sync(services []models.Service) {
-	logrus.Infof("Sync %d services", len(services))
+// Snapshot reads the servers, backends, frontends and links of the IPLB.
+func (i *IPLB) Snapshot() (*models.State, error) {
+	servers, err := i.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	backends, err := i.GetBackends()
+	if err != nil {
+		return nil, err
+	}
+	frontends, err := i.GetFrontends()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := i.GetRoutes()
+	if err != nil {
+		return nil, err
+	}
 
-	kind := "http"
-	weight := 100
+	links := make(map[int][]models.Link, len(backends))
+	for _, backend := range backends {
+		lks, err := i.GetLinksByBackendID(backend.ID)
+		if err != nil {
+			return nil, err
+		}
+		links[backend.ID] = lks
+	}
 
-	for _, service := range services {
+	zone, err := i.zone(servers)
+	if err != nil {
+		return nil, err
+	}
 
-		// Server
+	return &models.State{
+		Address:   i.Address,
+		Zone:      zone,
+		Servers:   servers,
+		Backends:  backends,
+		Frontends: frontends,
+		Routes:    routes,
+		Links:     links,
+	}, nil
+}
 
-		server, err := i.GetServerByAddress(i.Address)
-		if err != nil {
-			logrus.WithError(err).Error("Fail to get server")
-			return
+// zone returns the zone of the server of the host, the first zone of the
+// IPLB service before it is registered.
+func (i *IPLB) zone(servers []models.Server) (string, error) {
+	for _, server := range servers {
+		if server.Address == i.Address {
+			i.Zone = server.Zone
+			return i.Zone, nil
 		}
+	}
+	if i.Zone != "" {
+		return i.Zone, nil
+	}
 
-		if server == nil {
-			logrus.WithField("address", i.Address).Info("Add new server")
-			server, err = i.AddServer(i.Address, "active")
-			if err != nil {
-				logrus.WithError(err).Error("Fail to add server")
-				return
-			}
-		}
+	service, err := i.GetService()
+	if err != nil {
+		return "", err
+	}
+	if len(service.Zone) == 0 {
+		return "", fmt.Errorf("no zone for IPLB service %s", i.ServiceName)
+	}
 
-		logrus.WithField("zone", server.Zone).Info("Set zone")
-		i.Zone = server.Zone
+	i.Zone = service.Zone[0]
+	return i.Zone, nil
+}
 
-		// Backend
+func (i *IPLB) Plan(state *models.State, services []models.Service) *models.Plan {
+	return lb.Diff(state, services)
+}
 
-		backend, err := i.GetBackendByPortAndZone(service.Port, i.Zone)
-		if err != nil {
-			logrus.WithError(err).Error("Fail to get backend")
-			return
+// Apply makes the changes of a plan, stopping at the first failing one.
+func (i *IPLB) Apply(plan *models.Plan) error {
+	zone := plan.State.Zone
+	serverIDs := map[string]int{}
+	for _, server := range plan.State.Servers {
+		serverIDs[server.Address] = server.ID
+	}
+	backendIDs := map[string]int{}
+	for _, backend := range plan.State.Backends {
+		if backend.Name != "" && backend.Zone == zone {
+			backendIDs[backend.Name] = backend.ID
 		}
-
-		if backend == nil {
-			logrus.WithField("port", service.Port).Info("Add new backend")
-			backend, err = i.AddBackend(service.Port, kind, i.Zone, kind)
-			if err != nil {
-				logrus.WithError(err).Error("Fail to add backend")
-				return
+	}
+	frontendIDs := map[int]int{}
+	for _, frontend := range plan.State.Frontends {
+		if frontend.Zone == zone {
+			if port, err := strconv.Atoi(frontend.Port); err == nil && frontendIDs[port] == 0 {
+				frontendIDs[port] = frontend.ID
 			}
 		}
+	}
+	routes := map[int]models.Route{}
+	for _, route := range plan.State.Routes {
+		routes[route.ID] = route
+	}
 
-		// Frontend
+	for index, change := range plan.Changes {
+		service := change.Service
+		log := logrus.WithField("action", change.Action).WithField("backend", service.Backend)
 
-		frontend, err := i.GetFrontendByBackendID(backend.ID)
-		if err != nil {
-			logrus.WithError(err).Error("Fail to get frontend")
-			return
-		}
+		var err error
+		switch change.Kind {
 
-		if frontend == nil {
-			logrus.WithField("port", service.Port).Info("Add new frontend")
-			_, err = i.AddFrontend(backend.ID, false, service.Port, false, i.Zone)
+		case lb.KindServer:
+			log.WithField("address", service.Address).Info("Add new server")
+			var server *models.Server
+			server, err = i.AddServer(service.Address, "active")
+			if err == nil {
+				serverIDs[service.Address] = server.ID
+			}
 
-			if err != nil {
-				logrus.WithError(err).Error("Fail to add frontend")
-				return
+		case lb.KindBackend:
+			if change.Action == lb.ActionAdd {
+				log.WithField("port", service.Port).Info("Add new backend")
+				var backend *models.Backend
+				backend, err = i.AddBackend(lb.NewBackend(service, zone))
+				if err == nil {
+					backendIDs[service.Backend] = backend.ID
+				}
+			} else {
+				log.WithField("port", service.Port).Info("Update backend")
+				// The defaults are explicit, the IPLB keeping the fields left out
+				err = i.UpdateBackend(change.ID, &models.UpdateBackend{Name: service.Backend, Probe: lb.NormalizeProbe(service.Probe)})
+				backendIDs[service.Backend] = change.ID
 			}
-		}
 
-		// Links
+		case lb.KindFrontend:
+			log.WithField("port", service.FrontendPort).Info(strings.Title(change.Action) + " frontend")
+			if change.Action == lb.ActionAdd {
+				var frontend *models.Frontend
+				frontend, err = i.AddFrontend(lb.NewFrontend(service, zone, backendIDs[service.Backend]))
+				if err == nil {
+					frontendIDs[service.FrontendPort] = frontend.ID
+				}
+			} else {
+				err = i.UpdateFrontend(change.ID, lb.FrontendUpdate(service, backendIDs[service.Backend]))
+			}
 
-		link, err := i.GetLinkByBackendIDServerIDAndPort(backend.ID, server.ID, service.Port)
-		if err != nil {
-			logrus.WithError(err).Error("Fail to get link")
-			return
-		}
+		case lb.KindRoute:
+			log.WithField("host", service.Frontend).WithField("port", service.FrontendPort).
+				Info(strings.Title(change.Action) + " route")
+			route := routes[change.ID]
+			if change.Action == lb.ActionAdd {
+				var added *models.Route
+				added, err = i.AddRoute(&models.AddRoute{
+					BackendID:  backendIDs[service.Backend],
+					FrontendID: frontendIDs[service.FrontendPort],
+				})
+				if err == nil {
+					route = *added
+				}
+			} else if route.BackendID != backendIDs[service.Backend] {
+				err = i.UpdateRoute(route.ID, &models.UpdateRoute{BackendID: backendIDs[service.Backend]})
+			}
+			if err == nil && len(route.Rules) == 0 {
+				_, err = i.AddRouteRule(route.ID, lb.NewRouteRule(service))
+			}
 
-		if link == nil {
-			logrus.WithField("port", service.Port).Info("Add new link")
-			_, err = i.AddLink(backend.ID, false, service.Port, true, server.ID, false, weight)
-			if err != nil {
-				logrus.WithError(err).Error("Fail to add link")
-				return
+		case lb.KindLink:
+			log.WithField("address", service.Address).WithField("port", service.Port).
+				WithField("weight", service.Weight).Info(strings.Title(change.Action) + " link")
+			if change.Action == lb.ActionAdd {
+				_, err = i.AddLink(backendIDs[service.Backend], lb.NewLink(service, serverIDs[service.Address]))
+			} else {
+				err = i.UpdateLink(change.BackendID, change.ID, lb.LinkUpdate(service))
 			}
 		}
 
-		logrus.Infof("Service %v registered", service)
+		if err != nil {
+			return &lb.ApplyError{Index: index, Change: change, Err: err}
+		}
 	}
+
+	if len(plan.Changes) == 0 {
+		return nil
+	}
+
+	// Deploy the changes in the zone
+	_, err := i.Refresh(zone)
+	return err
+}
+
+func (i *IPLB) Refresh(zone string) (*models.Task, error) {
+	task := &models.Task{}
+	err := i.Client.Post(fmt.Sprintf("/ipLoadbalancing/%s/refresh", i.ServiceName), &models.Refresh{Zone: zone}, task)
+	if err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+func (i *IPLB) GetTaskByID(ID int) (*models.Task, error) {
+	var task models.Task
+	err := i.Client.Get(fmt.Sprintf("/ipLoadbalancing/%s/task/%d", i.ServiceName, ID), &task)
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// Check checks the OVH API is reachable and the credentials are valid for
+// the service.
+func (i *IPLB) Check() error {
+	_, err := i.GetService()
+	return err
 }
 
 func (i *IPLB) GetService() (*models.IPLBService, error) {
 	var service models.IPLBService
 	err := i.Client.Get(fmt.Sprintf("/ipLoadbalancing/%s", i.ServiceName), &service)
 	if err != nil {
-		logrus.WithError(err).Fatal("Fail to get IPLB service")
 		return nil, err
 	}
 
@@ -144,10 +272,8 @@ func (i *IPLB) GetService() (*models.IPLBService, error) {
 
 // --
 
-func (i *IPLB) AddBackend(port int, kind string, zone string, probe string) (*models.Backend, error) {
+func (i *IPLB) AddBackend(newBackend *models.AddBackend) (*models.Backend, error) {
 	var backend = &models.Backend{}
-	newBackend := &models.AddBackend{Port: port, Type: kind, Zone: zone, Probe: probe}
-	logrus.Warn(newBackend)
 	err := i.Client.Post(fmt.Sprintf("/ipLoadbalancing/%s/backend", i.ServiceName), newBackend, backend)
 	if err != nil {
 		return nil, err
@@ -156,6 +282,10 @@ func (i *IPLB) AddBackend(port int, kind string, zone string, probe string) (*mo
 	return backend, nil
 }
 
+func (i *IPLB) UpdateBackend(backendID int, updateBackend *models.UpdateBackend) error {
+	return i.Client.Put(fmt.Sprintf("/ipLoadbalancing/%s/backend/%d", i.ServiceName, backendID), updateBackend, nil)
+}
+
 func (i *IPLB) GetBackendByPortAndZone(port int, zone string) (*models.Backend, error) {
 	backends, err := i.GetBackends()
 	if err != nil {
@@ -185,11 +315,13 @@ func (i *IPLB) GetBackends() ([]models.Backend, error) {
 	wg.Add(nbBackends)
 
 	backends := make([]models.Backend, nbBackends)
+	errs := make([]error, nbBackends)
 	for index, ID := range IDs {
 		go func(ix int, id int) {
 			defer wg.Done()
 			backend, err := i.GetBackendByID(id)
 			if err != nil {
+				errs[ix] = err
 				return
 			}
 			backends[ix] = *backend
@@ -198,7 +330,7 @@ func (i *IPLB) GetBackends() ([]models.Backend, error) {
 
 	wg.Wait()
 
-	return backends, nil
+	return backends, firstError(errs)
 }
 
 func (i *IPLB) GetBackendByID(ID int) (*models.Backend, error) {
@@ -212,9 +344,8 @@ func (i *IPLB) GetBackendByID(ID int) (*models.Backend, error) {
 
 // --
 
-func (i *IPLB) AddFrontend(backendID int, HSTS bool, port int, SSL bool, zone string) (*models.Frontend, error) {
+func (i *IPLB) AddFrontend(newFrontend *models.AddFrontend) (*models.Frontend, error) {
 	var frontend = &models.Frontend{}
-	newFrontend := &models.AddFrontend{DefaultBackendID: backendID, HSTS: HSTS, Port: port, SSL: SSL, Zone: zone}
 	err := i.Client.Post(fmt.Sprintf("/ipLoadbalancing/%s/frontend", i.ServiceName), newFrontend, frontend)
 	if err != nil {
 		return nil, err
@@ -223,6 +354,10 @@ func (i *IPLB) AddFrontend(backendID int, HSTS bool, port int, SSL bool, zone st
 	return frontend, nil
 }
 
+func (i *IPLB) UpdateFrontend(ID int, updateFrontend *models.UpdateFrontend) error {
+	return i.Client.Put(fmt.Sprintf("/ipLoadbalancing/%s/frontend/%d", i.ServiceName, ID), updateFrontend, nil)
+}
+
 func (i *IPLB) GetFrontendByBackendID(backendID int) (*models.Frontend, error) {
 	var IDs []int
 	err := i.Client.Get(fmt.Sprintf("/ipLoadbalancing/%s/frontend?defaultBackendId=%d", i.ServiceName, backendID), &IDs)
@@ -257,11 +392,13 @@ func (i *IPLB) GetFrontends() ([]models.Frontend, error) {
 	wg.Add(nbFrontends)
 
 	frontends := make([]models.Frontend, nbFrontends)
+	errs := make([]error, nbFrontends)
 	for index, ID := range IDs {
 		go func(ix int, id int) {
 			defer wg.Done()
 			frontend, err := i.GetFrontendByID(id)
 			if err != nil {
+				errs[ix] = err
 				return
 			}
 			frontends[ix] = *frontend
@@ -270,7 +407,7 @@ func (i *IPLB) GetFrontends() ([]models.Frontend, error) {
 
 	wg.Wait()
 
-	return frontends, nil
+	return frontends, firstError(errs)
 }
 
 func (i *IPLB) GetFrontendByID(ID int) (*models.Frontend, error) {
@@ -282,6 +419,72 @@ func (i *IPLB) GetFrontendByID(ID int) (*models.Frontend, error) {
 	return &frontend, nil
 }
 
+// -- Routes
+
+func (i *IPLB) AddRoute(newRoute *models.AddRoute) (*models.Route, error) {
+	var route = &models.Route{}
+	err := i.Client.Post(fmt.Sprintf("/ipLoadbalancing/%s/route", i.ServiceName), newRoute, route)
+	if err != nil {
+		return nil, err
+	}
+
+	return route, nil
+}
+
+func (i *IPLB) UpdateRoute(ID int, updateRoute *models.UpdateRoute) error {
+	return i.Client.Put(fmt.Sprintf("/ipLoadbalancing/%s/route/%d", i.ServiceName, ID), updateRoute, nil)
+}
+
+func (i *IPLB) AddRouteRule(routeID int, newRule *models.AddRouteRule) (*models.RouteRule, error) {
+	var rule = &models.RouteRule{}
+	err := i.Client.Post(fmt.Sprintf("/ipLoadbalancing/%s/route/%d/rule", i.ServiceName, routeID), newRule, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func (i *IPLB) GetRoutes() ([]models.Route, error) {
+	var IDs []int
+	err := i.Client.Get(fmt.Sprintf("/ipLoadbalancing/%s/route", i.ServiceName), &IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	nbRoutes := len(IDs)
+
+	var wg sync.WaitGroup
+	wg.Add(nbRoutes)
+
+	routes := make([]models.Route, nbRoutes)
+	errs := make([]error, nbRoutes)
+	for index, ID := range IDs {
+		go func(ix int, id int) {
+			defer wg.Done()
+			route, err := i.GetRouteByID(id)
+			if err != nil {
+				errs[ix] = err
+				return
+			}
+			routes[ix] = *route
+		}(index, ID)
+	}
+
+	wg.Wait()
+
+	return routes, firstError(errs)
+}
+
+func (i *IPLB) GetRouteByID(ID int) (*models.Route, error) {
+	var route models.Route
+	err := i.Client.Get(fmt.Sprintf("/ipLoadbalancing/%s/route/%d", i.ServiceName, ID), &route)
+	if err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
 // --
 
 func (i *IPLB) AddServer(address string, status string) (*models.Server, error) {
@@ -329,11 +532,13 @@ func (i *IPLB) GetServers() ([]models.Server, error) {
 	wg.Add(nbServers)
 
 	servers := make([]models.Server, nbServers)
+	errs := make([]error, nbServers)
 	for index, ID := range IDs {
 		go func(ix int, id int) {
 			defer wg.Done()
 			server, err := i.GetServerByID(id)
 			if err != nil {
+				errs[ix] = err
 				return
 			}
 			servers[ix] = *server
@@ -342,7 +547,7 @@ func (i *IPLB) GetServers() ([]models.Server, error) {
 
 	wg.Wait()
 
-	return servers, nil
+	return servers, firstError(errs)
 }
 
 func (i *IPLB) GetServerByID(ID int) (*models.Server, error) {
@@ -356,9 +561,8 @@ func (i *IPLB) GetServerByID(ID int) (*models.Server, error) {
 
 // -- Links
 
-func (i *IPLB) AddLink(backendID int, backup bool, port int, probe bool, serverID int, SSL bool, weight int) (*models.Link, error) {
+func (i *IPLB) AddLink(backendID int, newLink *models.AddLink) (*models.Link, error) {
 	var link = &models.Link{}
-	newLink := &models.AddLink{Backup: backup, Port: port, Probe: probe, ServerID: serverID, SSL: SSL, Weight: weight}
 	err := i.Client.Post(fmt.Sprintf("/ipLoadbalancing/%s/backend/%d/server", i.ServiceName, backendID), newLink, link)
 	if err != nil {
 		return nil, err
@@ -367,6 +571,10 @@ func (i *IPLB) AddLink(backendID int, backup bool, port int, probe bool, serverI
 	return link, nil
 }
 
+func (i *IPLB) UpdateLink(backendID int, ID int, updateLink *models.UpdateLink) error {
+	return i.Client.Put(fmt.Sprintf("/ipLoadbalancing/%s/backend/%d/server/%d", i.ServiceName, backendID, ID), updateLink, nil)
+}
+
 func (i *IPLB) GetLinkByBackendIDServerIDAndPort(backendID int, serverID int, port int) (*models.Link, error) {
 	links, err := i.GetLinksByBackendID(backendID)
 	if err != nil {
@@ -396,11 +604,13 @@ func (i *IPLB) GetLinksByBackendID(backendID int) ([]models.Link, error) {
 	wg.Add(nbLinks)
 
 	links := make([]models.Link, nbLinks)
+	errs := make([]error, nbLinks)
 	for index, ID := range IDs {
 		go func(ix int, id int) {
 			defer wg.Done()
 			link, err := i.GetLinkByID(backendID, id)
 			if err != nil {
+				errs[ix] = err
 				return
 			}
 			links[ix] = *link
@@ -409,7 +619,7 @@ func (i *IPLB) GetLinksByBackendID(backendID int) ([]models.Link, error) {
 
 	wg.Wait()
 
-	return links, nil
+	return links, firstError(errs)
 }
 
 func (i *IPLB) GetLinkByID(backendID int, ID int) (*models.Link, error) {
@@ -420,3 +630,13 @@ func (i *IPLB) GetLinkByID(backendID int, ID int) (*models.Link, error) {
 	}
 	return &link, nil
 }
+
+// firstError returns the first error of a fan-out of requests.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
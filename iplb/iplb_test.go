@@ -0,0 +1,426 @@
+package iplb_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thbkrkr/iplb-docker/iplb"
+	"github.com/thbkrkr/iplb-docker/iplb/iplbtest"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const address = "10.0.0.1"
+
+func newIPLB(t *testing.T, server *iplbtest.Server) *iplb.IPLB {
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &iplb.IPLB{ServiceName: server.ServiceName, Address: address, Client: client}
+}
+
+func services() []models.Service {
+	probe := &models.Probe{Type: "http", URL: "/health"}
+	return []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: 32768, Weight: 100, FrontendPort: 80, Probe: probe},
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: 32769, Weight: 100, FrontendPort: 80, Probe: probe},
+		{Frontend: "api.example.com", Backend: "app_api", Address: "10.0.0.2", Port: 8080, Weight: 50,
+			FrontendPort: 443, FrontendSSL: true, AllowedSource: []string{"10.0.0.0/8"}},
+	}
+}
+
+func TestSync(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	plan, err := lb.Sync(target, services())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 11 {
+		t.Errorf("expected 11 changes, got %d: %v", len(plan.Changes), plan.Changes)
+	}
+
+	state := server.State()
+	if len(state.Servers) != 2 || len(state.Backends) != 2 || len(state.Frontends) != 2 || len(state.Routes) != 2 {
+		t.Fatalf("expected 2 servers, backends, frontends and routes, got %+v", state)
+	}
+	for _, route := range state.Routes {
+		if len(route.Rules) != 1 || route.Rules[0].Field != "host" || route.Rules[0].Match != "is" {
+			t.Errorf("expected a host rule, got %+v", route.Rules)
+		}
+	}
+	for _, backend := range state.Backends {
+		if backend.Zone != "gra" {
+			t.Errorf("expected backend %s in zone gra, got %s", backend.Name, backend.Zone)
+		}
+		links := state.Links[backend.ID]
+		switch backend.Name {
+		case "app_bim":
+			if len(links) != 2 || backend.Probe == nil || backend.Probe.URL != "/health" {
+				t.Errorf("expected 2 probed links in app_bim, got %+v with probe %v", links, backend.Probe)
+			}
+		case "app_api":
+			if len(links) != 1 || links[0].Weight != 50 {
+				t.Errorf("expected 1 link of weight 50 in app_api, got %+v", links)
+			}
+		default:
+			t.Errorf("unexpected backend %s", backend.Name)
+		}
+	}
+	if len(server.Tasks()) != 1 {
+		t.Errorf("expected the changes to be refreshed once, got %v", server.Tasks())
+	}
+
+	// Nothing changes once registered
+	plan, err = lb.Sync(target, services())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no change, got %v", plan.Changes)
+	}
+	if len(server.Tasks()) != 1 {
+		t.Errorf("expected no refresh without change, got %v", server.Tasks())
+	}
+
+	// Only the changed link and frontend are updated
+	updated := services()
+	updated[2].Weight = 10
+	updated[2].AllowedSource = []string{"192.168.0.0/16"}
+	plan, err = lb.Sync(target, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", plan.Changes)
+	}
+	for _, change := range plan.Changes {
+		if change.Action != lb.ActionUpdate {
+			t.Errorf("expected an update, got %v", change)
+		}
+	}
+	state = server.State()
+	for _, frontend := range state.Frontends {
+		if frontend.SSL && (len(frontend.AllowedSource) != 1 || frontend.AllowedSource[0] != "192.168.0.0/16") {
+			t.Errorf("expected the allowed sources to be updated, got %v", frontend.AllowedSource)
+		}
+	}
+}
+
+func TestSyncRemovesProbe(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	_, err := lb.Sync(target, services()[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unprobed := services()[:1]
+	unprobed[0].Probe = nil
+	plan, err := lb.Sync(target, unprobed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 2 {
+		t.Errorf("expected the backend and link to be updated, got %v", plan.Changes)
+	}
+	state := server.State()
+	if state.Backends[0].Probe != nil || state.Links[state.Backends[0].ID][0].Probe {
+		t.Errorf("expected the probe to be removed, got %+v and %+v", state.Backends[0], state.Links)
+	}
+
+	plan, err = lb.Sync(target, unprobed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no change, got %v", plan.Changes)
+	}
+}
+
+func TestSyncRemovesProbeField(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	_, err := lb.Sync(target, services()[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the url label, the probe is back to the default url
+	defaultURL := services()[:1]
+	defaultURL[0].Probe = &models.Probe{Type: "http"}
+	plan, err := lb.Sync(target, defaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Kind != lb.KindBackend {
+		t.Errorf("expected the backend to be updated, got %v", plan.Changes)
+	}
+	if probe := server.State().Backends[0].Probe; probe == nil || probe.URL != "/" {
+		t.Errorf("expected the default url to be sent, got %+v", probe)
+	}
+
+	plan, err = lb.Sync(target, defaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no change, got %v", plan.Changes)
+	}
+}
+
+func TestSyncRemovesLinkOptions(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	options := services()[2:]
+	options[0].SSL = true
+	options[0].Chain = "-----BEGIN CERTIFICATE-----"
+	options[0].Cookie = "api-1"
+	options[0].ProxyProtocol = "v2"
+	_, err := lb.Sync(target, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := lb.Sync(target, services()[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 {
+		t.Errorf("expected the link to be updated, got %v", plan.Changes)
+	}
+	state := server.State()
+	link := state.Links[state.Backends[0].ID][0]
+	if link.SSL || link.Chain != "" || link.Cookie != "" || link.ProxyProtocolVersion != "" {
+		t.Errorf("expected the link options to be removed, got %+v", link)
+	}
+
+	plan, err = lb.Sync(target, services()[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 || len(server.Tasks()) != 2 {
+		t.Errorf("expected no change nor refresh, got %v and %v", plan.Changes, server.Tasks())
+	}
+}
+
+func TestSyncAdoptsUnnamedBackend(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	ID := server.AddBackend(models.Backend{Port: 8080, Zone: "gra", Type: "http"})
+
+	_, err := lb.Sync(target, services()[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := server.State()
+	if len(state.Backends) != 1 || state.Backends[0].ID != ID || state.Backends[0].Name != "app_api" {
+		t.Errorf("expected backend %d to be named app_api, got %+v", ID, state.Backends)
+	}
+}
+
+func TestSyncSkipsConflicts(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	conflicting := services()
+	conflicting[2].FrontendPort = 80
+
+	plan, err := lb.Sync(target, conflicting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflict := plan.Conflicts["frontend/80"]
+	if !strings.Contains(conflict, "with and without SSL") {
+		t.Errorf("expected an SSL conflict on frontend port 80, got %v", plan.Conflicts)
+	}
+
+	// Only the frontend and its routes are skipped
+	state := server.State()
+	if len(state.Backends) != 2 || len(state.Links) != 2 || len(state.Frontends) != 0 || len(state.Routes) != 0 {
+		t.Errorf("expected the backends and links without frontend nor route, got %+v", state)
+	}
+
+	conflicting = services()
+	conflicting[2].FrontendPort = 80
+	conflicting[2].FrontendSSL = false
+	conflicting[2].AllowedSource = nil
+	conflicting[2].Frontend = "BIM.example.com"
+
+	plan, err = lb.Sync(target, conflicting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflict = plan.Conflicts["route/80/bim.example.com"]
+	if !strings.Contains(conflict, "routed to backends app_bim and app_api") {
+		t.Errorf("expected a route conflict on bim.example.com, got %v", plan.Conflicts)
+	}
+	state = server.State()
+	if len(state.Frontends) != 1 || len(state.Routes) != 0 {
+		t.Errorf("expected the frontend without route, got %+v", state)
+	}
+}
+
+func TestSyncSharesFrontend(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	shared := append(services()[:1],
+		models.Service{Frontend: "bam.example.com", Backend: "app_bam", Port: 32770, Weight: 100, FrontendPort: 80},
+		models.Service{Frontend: "bom.example.com", Backend: "app_bom", Address: "10.0.0.2", Port: 8080, Weight: 100, FrontendPort: 80},
+	)
+
+	_, err := lb.Sync(target, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := server.State()
+	if len(state.Frontends) != 1 || len(state.Routes) != 3 {
+		t.Fatalf("expected 1 frontend with 3 routes, got %+v", state)
+	}
+	for _, route := range state.Routes {
+		if route.FrontendID != state.Frontends[0].ID {
+			t.Errorf("expected route %d on frontend %d, got %d", route.ID, state.Frontends[0].ID, route.FrontendID)
+		}
+	}
+
+	plan, err := lb.Sync(target, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no change, got %v", plan.Changes)
+	}
+
+	// The hosts swapping their backends update their routes only
+	shared[1].Frontend = "bim.example.com"
+	shared[0].Frontend = "bam.example.com"
+	plan, err = lb.Sync(target, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 2 {
+		t.Errorf("expected 2 route changes, got %v", plan.Changes)
+	}
+	for _, change := range plan.Changes {
+		if change.Kind != lb.KindRoute || change.Action != lb.ActionUpdate {
+			t.Errorf("expected a route to be updated, got %v", change)
+		}
+	}
+}
+
+func TestAddFrontendRejectsUsedPort(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	_, err := target.AddFrontend(&models.AddFrontend{Port: 80, Zone: "gra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = target.AddFrontend(&models.AddFrontend{Port: 80, Zone: "gra"})
+	if err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected port 80 to be refused, got %v", err)
+	}
+}
+
+func TestSyncFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault iplbtest.Fault
+	}{
+		{"internal error on backend creation", iplbtest.Fault{Method: "POST", Path: "/backend", Status: 500, Times: 1}},
+		{"rate limited server listing", iplbtest.Fault{Method: "GET", Path: "/server", Status: 429, Times: 1}},
+		{"internal error on a link", iplbtest.Fault{Method: "GET", Path: "/backend/", Status: 500, Times: 1}},
+		{"latency over the client timeout", iplbtest.Fault{Path: "/frontend", Latency: 200 * time.Millisecond, Times: 1}},
+		{"internal error on a route rule", iplbtest.Fault{Method: "POST", Path: "/route/", Status: 500, Times: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := iplbtest.NewServer("loadbalancer-test")
+			defer server.Close()
+			target := newIPLB(t, server)
+			target.Client.Timeout = 100 * time.Millisecond
+
+			// Registered before the fault for the reads to fail too
+			_, err := lb.Sync(target, services()[:1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server.Inject(test.fault)
+			_, err = lb.Sync(target, services())
+			if err == nil {
+				t.Fatal("expected the sync to fail")
+			}
+
+			// The next sync converges without duplicates
+			_, err = lb.Sync(target, services())
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := server.State()
+			if len(state.Servers) != 2 || len(state.Backends) != 2 || len(state.Frontends) != 2 || len(state.Routes) != 2 {
+				t.Errorf("expected 2 servers, backends, frontends and routes, got %+v", state)
+			}
+			for _, route := range state.Routes {
+				if len(route.Rules) != 1 {
+					t.Errorf("expected route %d to have a rule, got %+v", route.ID, route.Rules)
+				}
+			}
+		})
+	}
+}
+
+func TestSignature(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+	target.Client.AppSecret = "wrong"
+
+	_, err := lb.Sync(target, services())
+	if err == nil || !strings.Contains(err.Error(), "Invalid signature") {
+		t.Errorf("expected an invalid signature error, got %v", err)
+	}
+	if len(server.State().Servers) != 0 {
+		t.Errorf("expected no change with an invalid signature")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	target := newIPLB(t, server)
+
+	if err := target.Check(); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+
+	target.Client.AppSecret = "wrong"
+	if err := target.Check(); err == nil || !strings.Contains(err.Error(), "Invalid signature") {
+		t.Errorf("expected an invalid signature error, got %v", err)
+	}
+
+	target.Client.AppSecret = iplbtest.AppSecret
+	server.Inject(iplbtest.Fault{Method: "GET", Status: 503, Times: 1})
+	if err := target.Check(); err == nil {
+		t.Errorf("expected the check to fail when the API is down")
+	}
+}
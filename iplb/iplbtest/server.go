@@ -0,0 +1,535 @@
+// Package iplbtest provides a fake OVH IPLB API for tests.
+package iplbtest
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const (
+	AppKey      = "test-ak"
+	AppSecret   = "test-as"
+	ConsumerKey = "test-ck"
+)
+
+// Fault makes the requests of a method, any when empty, whose path under the
+// IPLB service starts with Path wait Latency then fail with Status, when
+// set. It applies Times times, forever when 0.
+type Fault struct {
+	Method  string
+	Path    string
+	Status  int
+	Latency time.Duration
+	Times   int
+}
+
+// Server is a fake of the /ipLoadbalancing/{serviceName} endpoints of the OVH
+// API keeping its objects in memory. It only accepts the requests signed
+// with AppKey, AppSecret and ConsumerKey, like the OVH API does.
+type Server struct {
+	*httptest.Server
+	ServiceName string
+	Zones       []string
+
+	mu        sync.Mutex
+	lastID    int
+	servers   map[int]*models.Server
+	backends  map[int]*models.Backend
+	frontends map[int]*models.Frontend
+	routes    map[int]*models.Route
+	links     map[int]map[int]*models.Link
+	tasks     map[int]*models.Task
+	faults    []*Fault
+	requests  []string
+}
+
+func NewServer(serviceName string) *Server {
+	s := &Server{
+		ServiceName: serviceName,
+		Zones:       []string{"gra"},
+		servers:     map[int]*models.Server{},
+		backends:    map[int]*models.Backend{},
+		frontends:   map[int]*models.Frontend{},
+		routes:      map[int]*models.Route{},
+		links:       map[int]map[int]*models.Link{},
+		tasks:       map[int]*models.Task{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns an OVH client of the server.
+func (s *Server) Client() (*ovh.Client, error) {
+	return ovh.NewClient(s.URL, AppKey, AppSecret, ConsumerKey)
+}
+
+// Inject adds a fault to the next requests.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// Requests returns the requests received, as "<method> <path>" under the
+// IPLB service.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// State returns the objects of the server, sorted by ID.
+func (s *Server) State() *models.State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &models.State{Links: map[int][]models.Link{}}
+	for _, ID := range sortedIDs(s.servers) {
+		state.Servers = append(state.Servers, *s.servers[ID])
+	}
+	for _, ID := range sortedIDs(s.backends) {
+		state.Backends = append(state.Backends, *s.backends[ID])
+		for _, linkID := range sortedIDs(s.links[ID]) {
+			state.Links[ID] = append(state.Links[ID], *s.links[ID][linkID])
+		}
+	}
+	for _, ID := range sortedIDs(s.frontends) {
+		state.Frontends = append(state.Frontends, *s.frontends[ID])
+	}
+	for _, ID := range sortedIDs(s.routes) {
+		state.Routes = append(state.Routes, *s.routes[ID])
+	}
+	return state
+}
+
+// Tasks returns the tasks created by the refreshes.
+func (s *Server) Tasks() []models.Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := []models.Task{}
+	for _, ID := range sortedIDs(s.tasks) {
+		tasks = append(tasks, *s.tasks[ID])
+	}
+	return tasks
+}
+
+// AddBackend creates a backend directly, like one made by hand or by a
+// former version of the agent.
+func (s *Server) AddBackend(backend models.Backend) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backend.ID = s.nextID()
+	s.backends[backend.ID] = &backend
+	s.links[backend.ID] = map[int]*models.Link{}
+	return backend.ID
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		apiError(w, 400, err.Error())
+		return
+	}
+
+	if r.URL.Path == "/auth/time" {
+		reply(w, time.Now().Unix())
+		return
+	}
+
+	if err := verify(s.URL, r, body); err != nil {
+		apiError(w, 403, err.Error())
+		return
+	}
+
+	prefix := "/ipLoadbalancing/" + s.ServiceName
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		apiError(w, 404, "This service does not exist")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+path)
+	fault := s.fault(r.Method, path)
+	s.mu.Unlock()
+
+	if fault != nil {
+		time.Sleep(fault.Latency)
+		if fault.Status != 0 {
+			apiError(w, fault.Status, http.StatusText(fault.Status))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, response := s.route(r.Method, strings.Split(strings.Trim(path, "/"), "/"), r, body)
+	if status != http.StatusOK {
+		apiError(w, status, fmt.Sprint(response))
+		return
+	}
+	reply(w, response)
+}
+
+// fault returns the fault of a request, consuming it.
+func (s *Server) fault(method string, path string) *Fault {
+	for i, fault := range s.faults {
+		if (fault.Method != "" && fault.Method != method) || !strings.HasPrefix(path, fault.Path) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func (s *Server) route(method string, parts []string, r *http.Request, body []byte) (int, interface{}) {
+	if parts[0] == "" {
+		if method != "GET" {
+			return 405, "method not allowed"
+		}
+		return http.StatusOK, models.IPLBService{Zone: s.Zones, State: "ok"}
+	}
+
+	var ID, subID int
+	var err error
+	if len(parts) > 1 {
+		if ID, err = strconv.Atoi(parts[1]); err != nil {
+			return 400, "invalid id " + parts[1]
+		}
+	}
+	if len(parts) > 3 {
+		if subID, err = strconv.Atoi(parts[3]); err != nil {
+			return 400, "invalid id " + parts[3]
+		}
+	}
+
+	switch {
+	case parts[0] == "server" && len(parts) == 1:
+		return s.serverCollection(method, r, body)
+	case parts[0] == "server" && len(parts) == 2 && method == "GET":
+		if server, ok := s.servers[ID]; ok {
+			return http.StatusOK, server
+		}
+
+	case parts[0] == "backend" && len(parts) == 1:
+		return s.backendCollection(method, body)
+	case parts[0] == "backend" && len(parts) == 2:
+		if backend, ok := s.backends[ID]; ok {
+			return update(method, backend, body)
+		}
+
+	case parts[0] == "backend" && len(parts) == 3 && parts[2] == "server":
+		if _, ok := s.backends[ID]; ok {
+			return s.linkCollection(method, ID, body)
+		}
+	case parts[0] == "backend" && len(parts) == 4 && parts[2] == "server":
+		if link, ok := s.links[ID][subID]; ok {
+			return update(method, link, body)
+		}
+
+	case parts[0] == "frontend" && len(parts) == 1:
+		return s.frontendCollection(method, r, body)
+	case parts[0] == "frontend" && len(parts) == 2:
+		if frontend, ok := s.frontends[ID]; ok {
+			return s.updateFrontend(method, frontend, body)
+		}
+
+	case parts[0] == "route" && len(parts) == 1:
+		return s.routeCollection(method, body)
+	case parts[0] == "route" && len(parts) == 2:
+		if route, ok := s.routes[ID]; ok {
+			return update(method, route, body)
+		}
+	case parts[0] == "route" && len(parts) == 3 && parts[2] == "rule" && method == "POST":
+		if route, ok := s.routes[ID]; ok {
+			rule := models.RouteRule{}
+			if err := json.Unmarshal(body, &rule); err != nil {
+				return 400, err.Error()
+			}
+			rule.ID = s.nextID()
+			route.Rules = append(route.Rules, rule)
+			return http.StatusOK, rule
+		}
+
+	case parts[0] == "refresh" && len(parts) == 1 && method == "POST":
+		task := &models.Task{ID: s.nextID(), Action: "refreshIplb", Status: "done", CreationDate: time.Now().Format(time.RFC3339)}
+		s.tasks[task.ID] = task
+		return http.StatusOK, task
+	case parts[0] == "task" && len(parts) == 1 && method == "GET":
+		return http.StatusOK, sortedIDs(s.tasks)
+	case parts[0] == "task" && len(parts) == 2 && method == "GET":
+		if task, ok := s.tasks[ID]; ok {
+			return http.StatusOK, task
+		}
+	}
+
+	return 404, "The requested object does not exist"
+}
+
+func (s *Server) serverCollection(method string, r *http.Request, body []byte) (int, interface{}) {
+	switch method {
+	case "GET":
+		IDs := []int{}
+		for _, ID := range sortedIDs(s.servers) {
+			if address := r.URL.Query().Get("address"); address == "" || s.servers[ID].Address == address {
+				IDs = append(IDs, ID)
+			}
+		}
+		return http.StatusOK, IDs
+	case "POST":
+		server := &models.Server{}
+		if err := json.Unmarshal(body, server); err != nil {
+			return 400, err.Error()
+		}
+		server.ID = s.nextID()
+		server.Type = "ipv4"
+		server.Zone = s.Zones[0]
+		s.servers[server.ID] = server
+		return http.StatusOK, server
+	}
+	return 405, "method not allowed"
+}
+
+func (s *Server) backendCollection(method string, body []byte) (int, interface{}) {
+	switch method {
+	case "GET":
+		return http.StatusOK, sortedIDs(s.backends)
+	case "POST":
+		backend := &models.Backend{}
+		if err := json.Unmarshal(body, backend); err != nil {
+			return 400, err.Error()
+		}
+		if !s.zone(backend.Zone) {
+			return 400, "unknown zone " + backend.Zone
+		}
+		backend.ID = s.nextID()
+		s.backends[backend.ID] = backend
+		s.links[backend.ID] = map[int]*models.Link{}
+		return http.StatusOK, backend
+	}
+	return 405, "method not allowed"
+}
+
+func (s *Server) linkCollection(method string, backendID int, body []byte) (int, interface{}) {
+	switch method {
+	case "GET":
+		return http.StatusOK, sortedIDs(s.links[backendID])
+	case "POST":
+		link := &models.Link{}
+		if err := json.Unmarshal(body, link); err != nil {
+			return 400, err.Error()
+		}
+		if _, ok := s.servers[link.ServerID]; !ok {
+			return 400, fmt.Sprintf("unknown server %d", link.ServerID)
+		}
+		link.ID = s.nextID()
+		s.links[backendID][link.ID] = link
+		return http.StatusOK, link
+	}
+	return 405, "method not allowed"
+}
+
+func (s *Server) frontendCollection(method string, r *http.Request, body []byte) (int, interface{}) {
+	switch method {
+	case "GET":
+		IDs := []int{}
+		for _, ID := range sortedIDs(s.frontends) {
+			backendID := r.URL.Query().Get("defaultBackendId")
+			if backendID == "" || strconv.Itoa(s.frontends[ID].DefaultBackendID) == backendID {
+				IDs = append(IDs, ID)
+			}
+		}
+		return http.StatusOK, IDs
+	case "POST":
+		add := &models.AddFrontend{}
+		if err := json.Unmarshal(body, add); err != nil {
+			return 400, err.Error()
+		}
+		if _, ok := s.backends[add.DefaultBackendID]; add.DefaultBackendID != 0 && !ok {
+			return 400, fmt.Sprintf("unknown backend %d", add.DefaultBackendID)
+		}
+		if !s.zone(add.Zone) {
+			return 400, "unknown zone " + add.Zone
+		}
+		if s.portUsed(add.Zone, strconv.Itoa(add.Port), 0) {
+			return 409, fmt.Sprintf("port %d is already used by a frontend of zone %s", add.Port, add.Zone)
+		}
+		frontend := &models.Frontend{
+			ID:               s.nextID(),
+			AllowedSource:    add.AllowedSource,
+			DefaultBackendID: add.DefaultBackendID,
+			HSTS:             add.HSTS,
+			HTTPHeader:       add.HTTPHeader,
+			Port:             strconv.Itoa(add.Port),
+			SSL:              add.SSL,
+			Zone:             add.Zone,
+		}
+		s.frontends[frontend.ID] = frontend
+		return http.StatusOK, frontend
+	}
+	return 405, "method not allowed"
+}
+
+// updateFrontend is update refusing to move a frontend to a port already
+// used in its zone.
+func (s *Server) updateFrontend(method string, frontend *models.Frontend, body []byte) (int, interface{}) {
+	if method == "PUT" {
+		updated := *frontend
+		if err := json.Unmarshal(body, &updated); err != nil {
+			return 400, err.Error()
+		}
+		if s.portUsed(updated.Zone, updated.Port, updated.ID) {
+			return 409, fmt.Sprintf("port %s is already used by a frontend of zone %s", updated.Port, updated.Zone)
+		}
+	}
+	return update(method, frontend, body)
+}
+
+// portUsed reports whether a frontend other than ID listens on a port of a
+// zone, the IPLB having a single frontend by port.
+func (s *Server) portUsed(zone string, port string, ID int) bool {
+	for _, frontend := range s.frontends {
+		if frontend.ID != ID && frontend.Zone == zone && frontend.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) routeCollection(method string, body []byte) (int, interface{}) {
+	switch method {
+	case "GET":
+		return http.StatusOK, sortedIDs(s.routes)
+	case "POST":
+		route := &models.Route{}
+		if err := json.Unmarshal(body, route); err != nil {
+			return 400, err.Error()
+		}
+		if _, ok := s.frontends[route.FrontendID]; !ok {
+			return 400, fmt.Sprintf("unknown frontend %d", route.FrontendID)
+		}
+		if _, ok := s.backends[route.BackendID]; !ok {
+			return 400, fmt.Sprintf("unknown backend %d", route.BackendID)
+		}
+		route.ID = s.nextID()
+		route.Rules = []models.RouteRule{}
+		s.routes[route.ID] = route
+		return http.StatusOK, route
+	}
+	return 405, "method not allowed"
+}
+
+// update returns an object or sets the fields of the body in it, the update
+// payloads sharing the JSON names of the objects.
+func update(method string, object interface{}, body []byte) (int, interface{}) {
+	switch method {
+	case "GET":
+		return http.StatusOK, object
+	case "PUT":
+		if err := json.Unmarshal(body, object); err != nil {
+			return 400, err.Error()
+		}
+		return http.StatusOK, nil
+	}
+	return 405, "method not allowed"
+}
+
+func (s *Server) zone(zone string) bool {
+	for _, z := range s.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// verify checks the signature of a request like the OVH API does.
+func verify(endpoint string, r *http.Request, body []byte) error {
+	if r.Header.Get("X-Ovh-Application") != AppKey {
+		return fmt.Errorf("Invalid application key")
+	}
+	if r.Header.Get("X-Ovh-Consumer") != ConsumerKey {
+		return fmt.Errorf("Invalid credential")
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s+%s+%s+%s%s+%s+%s", AppSecret, ConsumerKey, r.Method, endpoint, r.URL.RequestURI(),
+		body, r.Header.Get("X-Ovh-Timestamp"))
+	if r.Header.Get("X-Ovh-Signature") != fmt.Sprintf("$1$%x", h.Sum(nil)) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+func reply(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if response == nil {
+		w.Write([]byte("null"))
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func sortedIDs(objects interface{}) []int {
+	IDs := []int{}
+	switch objects := objects.(type) {
+	case map[int]*models.Server:
+		for ID := range objects {
+			IDs = append(IDs, ID)
+		}
+	case map[int]*models.Backend:
+		for ID := range objects {
+			IDs = append(IDs, ID)
+		}
+	case map[int]*models.Frontend:
+		for ID := range objects {
+			IDs = append(IDs, ID)
+		}
+	case map[int]*models.Route:
+		for ID := range objects {
+			IDs = append(IDs, ID)
+		}
+	case map[int]*models.Link:
+		for ID := range objects {
+			IDs = append(IDs, ID)
+		}
+	case map[int]*models.Task:
+		for ID := range objects {
+			IDs = append(IDs, ID)
+		}
+	}
+	sort.Ints(IDs)
+	return IDs
+}
@@ -0,0 +1,176 @@
+// Package record captures the interactions of the OVH client with the API
+// into fixture files and replays them offline.
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveHeaders are the credentials and signature of the OVH requests.
+var sensitiveHeaders = []string{"X-Ovh-Application", "X-Ovh-Consumer", "X-Ovh-Signature", "X-Ovh-Timestamp"}
+
+// Interaction is a request to the API and its response. The request is
+// identified by its method, its URI without the endpoint host and its body,
+// so a session is replayed with an endpoint of the same path, like /1.0 for
+// the OVH ones.
+type Interaction struct {
+	Method   string      `json:"method"`
+	URI      string      `json:"uri"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	Status   int         `json:"status"`
+	Response string      `json:"response"`
+}
+
+// Recorder is a transport saving the interactions to a fixture file after
+// each request, the credentials and signatures being redacted.
+type Recorder struct {
+	Path      string
+	Transport http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []Interaction
+}
+
+func NewRecorder(path string, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{Path: path, Transport: transport, interactions: []Interaction{}}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(response))
+
+	header := http.Header{}
+	for name, values := range req.Header {
+		header[name] = values
+	}
+	for _, name := range sensitiveHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, redacted)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.interactions = append(r.interactions, Interaction{
+		Method:   req.Method,
+		URI:      req.URL.RequestURI(),
+		Header:   header,
+		Body:     string(body),
+		Status:   resp.StatusCode,
+		Response: string(response),
+	})
+
+	content, err := json.MarshalIndent(r.interactions, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return resp, ioutil.WriteFile(r.Path, content, 0644)
+}
+
+// Replayer is a transport answering the requests with the responses of a
+// fixture file, each interaction being replayed once in the recorded order
+// of the identical requests.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	replayed     []bool
+}
+
+func NewReplayer(path string) (*Replayer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var interactions []Interaction
+	if err := json.Unmarshal(content, &interactions); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %s", path, err)
+	}
+
+	return &Replayer{interactions: interactions, replayed: make([]bool, len(interactions))}, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, interaction := range r.interactions {
+		if r.replayed[i] || interaction.Method != req.Method || interaction.URI != req.URL.RequestURI() ||
+			interaction.Body != string(body) {
+			continue
+		}
+		r.replayed[i] = true
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+			StatusCode:    interaction.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(interaction.Response))),
+			ContentLength: int64(len(interaction.Response)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no recorded interaction for %s %s %s", req.Method, req.URL.RequestURI(), body)
+}
+
+// Remaining returns the number of interactions not replayed yet.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	remaining := 0
+	for _, replayed := range r.replayed {
+		if !replayed {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// readBody returns the body of a request, restoring it for the transport.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,120 @@
+package record_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ovh/go-ovh/ovh"
+	"github.com/thbkrkr/iplb-docker/iplb"
+	"github.com/thbkrkr/iplb-docker/iplb/iplbtest"
+	"github.com/thbkrkr/iplb-docker/iplb/record"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+var update = flag.Bool("update", false, "record the fixtures against the fake IPLB API")
+
+const fixture = "testdata/sync.json"
+
+var services = []models.Service{
+	{Frontend: "bim.example.com", Backend: "app_bim", Port: 32768, Weight: 100, FrontendPort: 80,
+		Probe: &models.Probe{Type: "http", URL: "/health"}},
+	{Frontend: "api.example.com", Backend: "app_api", Address: "10.0.0.2", Port: 8080, Weight: 50,
+		FrontendPort: 443, FrontendSSL: true, AllowedSource: []string{"10.0.0.0/8"}},
+}
+
+// session registers the services twice then reads the backends and
+// frontends, returning the number of changes of each sync.
+func session(t *testing.T, client *ovh.Client) ([]int, []models.Backend, []models.Frontend) {
+	target := &iplb.IPLB{ServiceName: "loadbalancer-test", Address: "10.0.0.1", Client: client}
+
+	changes := []int{}
+	for i := 0; i < 2; i++ {
+		plan, err := lb.Sync(target, services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, len(plan.Changes))
+	}
+
+	backends, err := target.GetBackends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontends, err := target.GetFrontends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes, backends, frontends
+}
+
+func TestRecord(t *testing.T) {
+	if !*update {
+		t.Skip("fixtures are recorded with -update")
+	}
+
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Transport = record.NewRecorder(fixture, nil)
+
+	session(t, client)
+}
+
+func TestReplay(t *testing.T) {
+	content, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{iplbtest.AppKey, iplbtest.ConsumerKey, "$1$"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("expected %s to be redacted from the fixture", secret)
+		}
+	}
+
+	replayer, err := record.NewReplayer(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ovh.NewClient("http://replay.invalid", "ak", "as", "ck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Transport = replayer
+
+	changes, backends, frontends := session(t, client)
+	if len(changes) != 2 || changes[0] != 10 || changes[1] != 0 {
+		t.Errorf("expected 10 changes then none, got %v", changes)
+	}
+	if len(backends) != 2 || backends[0].Name != "app_bim" || backends[1].Name != "app_api" {
+		t.Errorf("unexpected backends %+v", backends)
+	}
+	if len(frontends) != 2 || frontends[1].Port != "443" || !frontends[1].SSL {
+		t.Errorf("unexpected frontends %+v", frontends)
+	}
+	if replayer.Remaining() != 0 {
+		t.Errorf("expected the whole session to be replayed, %d interactions left", replayer.Remaining())
+	}
+}
+
+func TestReplayUnknownRequest(t *testing.T) {
+	replayer, err := record.NewReplayer(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ovh.NewClient("http://replay.invalid", "ak", "as", "ck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Transport = replayer
+
+	err = client.Get("/ipLoadbalancing/unknown", nil)
+	if err == nil || !strings.Contains(err.Error(), "no recorded interaction") {
+		t.Errorf("expected an unrecorded request to fail, got %v", err)
+	}
+}
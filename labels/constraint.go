@@ -0,0 +1,321 @@
+package labels
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Constraint selects containers from their labels.
+type Constraint func(labels map[string]string) bool
+
+// ParseConstraint parses a constraint expression like
+//
+//	label com.docker.compose.project in (shop, api) && !label env=dev
+//
+// Terms are "label KEY" for a label set, "label KEY=VALUE",
+// "label KEY!=VALUE", "label KEY in (VALUE, ...)", and the functions
+// Label("KEY", "VALUE") and LabelRegex("KEY", "REGEX"), the regular
+// expression matching the whole value. They are combined with !, &&, || and
+// parentheses. An empty expression matches everything. Syntax errors give
+// the column of the faulty token.
+func ParseConstraint(expression string) (Constraint, error) {
+	if strings.TrimSpace(expression) == "" {
+		return func(map[string]string) bool { return true }, nil
+	}
+
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &constraintParser{tokens: tokens, end: len([]rune(expression)) + 1}
+	constraint, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return constraint, nil
+}
+
+// token is an operator or word of a constraint starting at a column. Quoted
+// words are never operators.
+type token struct {
+	text   string
+	quoted bool
+	column int
+}
+
+type constraintParser struct {
+	tokens []token
+	pos    int
+	// end is the column after the expression.
+	end int
+}
+
+// peek returns the next operator, empty for a word or at the end.
+func (p *constraintParser) peek() string {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *constraintParser) next() token {
+	if p.pos >= len(p.tokens) {
+		p.pos++
+		return token{column: p.end}
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+// errorf returns an error at the column of the next token.
+func (p *constraintParser) errorf(format string, args ...interface{}) error {
+	column := p.end
+	if p.pos < len(p.tokens) {
+		column = p.tokens[p.pos].column
+	}
+	return fmt.Errorf("%s at column %d of constraint", fmt.Sprintf(format, args...), column)
+}
+
+func (p *constraintParser) expect(text string) error {
+	if p.pos >= len(p.tokens) || p.peek() != text {
+		return p.errorf("expected %q, got %s", text, p.describe())
+	}
+	p.pos++
+	return nil
+}
+
+// word returns the next token when it is a label name or value.
+func (p *constraintParser) word(what string) (string, error) {
+	if p.pos >= len(p.tokens) || !isWord(p.tokens[p.pos]) {
+		return "", p.errorf("expected %s, got %s", what, p.describe())
+	}
+	return p.next().text, nil
+}
+
+// describe names the next token for errors.
+func (p *constraintParser) describe() string {
+	if p.pos >= len(p.tokens) {
+		return "the end"
+	}
+	return fmt.Sprintf("%q", p.tokens[p.pos].text)
+}
+
+func (p *constraintParser) or() (Constraint, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(labels map[string]string) bool { return l(labels) || right(labels) }
+	}
+	return left, nil
+}
+
+func (p *constraintParser) and() (Constraint, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(labels map[string]string) bool { return l(labels) && right(labels) }
+	}
+	return left, nil
+}
+
+func (p *constraintParser) unary() (Constraint, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(labels map[string]string) bool { return !operand(labels) }, nil
+	case "(":
+		p.next()
+		constraint, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return constraint, nil
+	case "Label", "LabelRegex":
+		return p.function()
+	}
+	return p.term()
+}
+
+// function parses Label("KEY", "VALUE") and LabelRegex("KEY", "REGEX").
+func (p *constraintParser) function() (Constraint, error) {
+	name := p.next().text
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	key, err := p.word("a label name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	value, err := p.word("a value for label " + key)
+	if err != nil {
+		return nil, err
+	}
+	column := p.tokens[p.pos-1].column
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if name == "Label" {
+		return func(labels map[string]string) bool {
+			v, ok := labels[key]
+			return ok && v == value
+		}, nil
+	}
+	re, err := regexp.Compile("^(?:" + value + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q at column %d of constraint: %s", value, column, err)
+	}
+	return func(labels map[string]string) bool {
+		v, ok := labels[key]
+		return ok && re.MatchString(v)
+	}, nil
+}
+
+func (p *constraintParser) term() (Constraint, error) {
+	if err := p.expect("label"); err != nil {
+		return nil, err
+	}
+	key, err := p.word("a label name")
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.peek() {
+	case "=", "!=":
+		operator := p.next().text
+		value, err := p.word("a value for label " + key)
+		if err != nil {
+			return nil, err
+		}
+		if operator == "=" {
+			return func(labels map[string]string) bool {
+				v, ok := labels[key]
+				return ok && v == value
+			}, nil
+		}
+		return func(labels map[string]string) bool { return labels[key] != value }, nil
+
+	case "in":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		values := map[string]bool{}
+		for {
+			value, err := p.word("a value for label " + key)
+			if err != nil {
+				return nil, err
+			}
+			values[value] = true
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(labels map[string]string) bool {
+			v, ok := labels[key]
+			return ok && values[v]
+		}, nil
+	}
+
+	return func(labels map[string]string) bool {
+		_, ok := labels[key]
+		return ok
+	}, nil
+}
+
+// isWord reports whether a token is a label name or value.
+func isWord(t token) bool {
+	if t.quoted {
+		return true
+	}
+	switch t.text {
+	case "", "!", "!=", "=", "(", ")", ",", "&&", "||":
+		return false
+	}
+	return true
+}
+
+// tokenize splits a constraint into operators, double-quoted strings and
+// words, with their column starting at 1. Quotes are removed from the
+// strings.
+func tokenize(expression string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, fmt.Errorf("unexpected %q at column %d of constraint", r, i+1)
+			}
+			tokens = append(tokens, token{text: string([]rune{r, r}), column: i + 1})
+			i += 2
+		case r == '!' && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, token{text: "!=", column: i + 1})
+			i += 2
+		case strings.ContainsRune("!=(),", r):
+			tokens = append(tokens, token{text: string(r), column: i + 1})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at column %d of constraint", i+1)
+			}
+			tokens = append(tokens, token{text: string(runes[i+1 : end]), quoted: true, column: i + 1})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("!=(),&|\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, token{text: string(runes[i:end]), column: i + 1})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
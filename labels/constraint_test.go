@@ -0,0 +1,120 @@
+package labels
+
+import "testing"
+
+func TestConstraint(t *testing.T) {
+	shop := map[string]string{"com.docker.compose.project": "shop", "env": "prod", "tier": "web-1"}
+	api := map[string]string{"com.docker.compose.project": "api", "env": "dev"}
+	bare := map[string]string{}
+
+	tests := []struct {
+		expression string
+		labels     map[string]string
+		expected   bool
+	}{
+		{"", bare, true},
+		{"label env", shop, true},
+		{"label env", bare, false},
+		{"label env=prod", shop, true},
+		{"label env=prod", api, false},
+		{"label env!=dev", shop, true},
+		{"label env!=dev", bare, true},
+		{"label env!=dev", api, false},
+		{"label com.docker.compose.project in (shop, api)", api, true},
+		{"label com.docker.compose.project in (shop, api)", bare, false},
+		{`label env="prod"`, shop, true},
+		{"label env && label tier", shop, true},
+		{"label env && label tier", api, false},
+		{"label tier || label env=dev", api, true},
+		{"label tier || label env=dev", bare, false},
+		{"!label env", bare, true},
+		{"!!label env", shop, true},
+		{"label com.docker.compose.project in (shop, api) && !label env=dev", shop, true},
+		{"label com.docker.compose.project in (shop, api) && !label env=dev", api, false},
+		{"label tier || label env && label env=dev", shop, true},
+		{"(label tier || label env) && label env=dev", shop, false},
+		{"!(label tier || label env=dev)", bare, true},
+		{`Label("env", "prod")`, shop, true},
+		{`Label("env", "prod")`, api, false},
+		{`Label("env", "prod")`, bare, false},
+		{`LabelRegex("tier", "web-[0-9]+")`, shop, true},
+		{`LabelRegex("tier", "web")`, shop, false},
+		{`LabelRegex("tier", ".*")`, bare, false},
+		{`Label("env", "dev") || LabelRegex("com.docker.compose.project", "sh.p")`, shop, true},
+		{`!Label("env", "dev") && label tier`, api, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			constraint, err := ParseConstraint(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if constraint(test.labels) != test.expected {
+				t.Errorf("expected %v for %v", test.expected, test.labels)
+			}
+		})
+	}
+}
+
+func TestConstraintSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"env=prod", `expected "label", got "env" at column 1 of constraint`},
+		{"label", `expected a label name, got the end at column 6 of constraint`},
+		{"label env=", `expected a value for label env, got the end at column 11 of constraint`},
+		{"label env in shop", `expected "(", got "shop" at column 14 of constraint`},
+		{"label env in (shop,)", `expected a value for label env, got ")" at column 20 of constraint`},
+		{"label env & label tier", `unexpected '&' at column 11 of constraint`},
+		{"label env && ", `expected "label", got the end at column 14 of constraint`},
+		{"(label env", `expected ")", got the end at column 11 of constraint`},
+		{"label env)", `unexpected ")" at column 10 of constraint`},
+		{`label env="prod`, `unterminated string at column 11 of constraint`},
+		{`Label("env")`, `expected ",", got ")" at column 12 of constraint`},
+		{`Label "env"`, `expected "(", got "env" at column 7 of constraint`},
+		{`LabelRegex("env", "(")`, "invalid regular expression \"(\" at column 19 of constraint: error parsing regexp: missing closing ): `^(?:()$`"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			_, err := ParseConstraint(test.expression)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestExposed(t *testing.T) {
+	tests := []struct {
+		name             string
+		exposedByDefault bool
+		constraint       string
+		labels           map[string]string
+		expected         bool
+	}{
+		{"exposed by default", true, "", map[string]string{}, true},
+		{"opt-out", true, "", map[string]string{"iplb.enable": "false"}, false},
+		{"not exposed by default", false, "", map[string]string{}, false},
+		{"opt-in", false, "", map[string]string{"iplb.enable": "true"}, true},
+		{"invalid enable label", true, "", map[string]string{"iplb.enable": "yes please"}, false},
+		{"constraint matched", true, "label env=prod", map[string]string{"env": "prod"}, true},
+		{"constraint not matched", true, "label env=prod", map[string]string{"env": "dev"}, false},
+		{"constraint before opt-in", false, "label env=prod", map[string]string{"env": "dev", "iplb.enable": "true"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser, err := NewParser("iplb", "", test.exposedByDefault, test.constraint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			container := NewContainer("1", "/apish", "krkr/apish", nil, test.labels)
+			if parser.Exposed(container) != test.expected {
+				t.Errorf("expected exposed to be %v", test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package labels
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// Container holds the metadata of a container the label values can refer to
+// as Go templates, like {{.Name}}.{{.Env.DOMAIN}}.
+type Container struct {
+	ID      string
+	Name    string
+	Image   string
+	Env     map[string]string
+	Labels  map[string]string
+	Project string
+	Service string
+}
+
+// NewContainer builds the metadata of a container from its name, environment
+// as KEY=value strings, and labels.
+func NewContainer(ID string, name string, image string, env []string, labels map[string]string) Container {
+	container := Container{
+		ID:      ID,
+		Name:    strings.TrimPrefix(name, "/"),
+		Image:   image,
+		Env:     map[string]string{},
+		Labels:  labels,
+		Project: labels[composeProjectLabel],
+		Service: labels[composeServiceLabel],
+	}
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) == 2 {
+			container.Env[parts[0]] = parts[1]
+		}
+	}
+	return container
+}
+
+// hostname returns the default host name of the container in a domain:
+// <service>.<project>.<domain> for compose services, <name>.<domain> otherwise.
+func (c Container) hostname(domain string) string {
+	if c.Project != "" && c.Service != "" {
+		return fmt.Sprintf("%s.%s.%s", hostLabel(c.Service), hostLabel(c.Project), domain)
+	}
+	return fmt.Sprintf("%s.%s", hostLabel(c.Name), domain)
+}
+
+// hostLabel makes a name usable as a DNS label.
+func hostLabel(name string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name), "-")
+}
+
+// render evaluates a label value as a Go template against the container.
+func render(value string, container Container) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+
+	tmpl, err := template.New("label").Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, container); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,522 @@
+package labels
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const (
+	// FrontendRuleLabel and AddressLabel are read by the providers setting
+	// the frontend rule or the address of a server from their own source.
+	FrontendRuleLabel = frontendLabel
+	AddressLabel      = "address"
+
+	enableLabel = "enable"
+
+	backendLabel  = "backend"
+	frontendLabel = "frontend.rule"
+	portLabel     = "port"
+	typeLabel     = "type"
+
+	weightLabel        = "weight"
+	backupLabel        = "backup"
+	proxyProtocolLabel = "proxyprotocol"
+	sslLabel           = "ssl"
+	sslChainLabel      = "ssl.chain"
+	cookieLabel        = "cookie"
+
+	frontendPortLabel = "frontend.port"
+	frontendSSLLabel  = "frontend.ssl"
+	allowLabel        = "allow"
+	headerLabelPrefix = "header."
+
+	defaultFrontendPort    = 80
+	defaultFrontendSSLPort = 443
+
+	defaultWeight = 100
+	maxWeight     = 256
+
+	probeTypeLabel     = "probe.type"
+	probeURLLabel      = "probe.url"
+	probeMethodLabel   = "probe.method"
+	probeStatusLabel   = "probe.status"
+	probeRegexLabel    = "probe.regex"
+	probeIntervalLabel = "probe.interval"
+	probeNegateLabel   = "probe.negate"
+
+	defaultProbeType = "http"
+	noProbeType      = "none"
+)
+
+var (
+	probeTypes   = []string{"http", "tcp", "oco", "smtp", "mysql", "pgsql"}
+	probeMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+	proxyProtocolVersions = []string{"v1", "v2", "v2-ssl", "v2-ssl-cn"}
+
+	serviceTypes = []string{"http", "tcp"}
+
+	// options are the first segments of the labels configuring a service, and
+	// the reserved enable and version labels. Any other segment followed by
+	// ".port" names a group of labels.
+	options = []string{"backend", "frontend", "port", "type", "weight", "backup", "proxyprotocol",
+		"ssl", "cookie", "allow", "header", "probe", enableLabel, versionLabel}
+)
+
+// Parser reads the services exposed by a container from its labels. The
+// backend defaults to the compose service. When a default domain is set, the
+// frontend rule defaults to a host name in this domain and the backend of
+// other containers to their name, so a port is enough.
+//
+// Only the containers matching the constraint are read. Among them, the
+// containers are exposed by default or when their enable label is true.
+type Parser struct {
+	Prefix           string
+	DefaultDomain    string
+	ExposedByDefault bool
+	Constraint       Constraint
+}
+
+func NewParser(prefix string, defaultDomain string, exposedByDefault bool, constraint string) (*Parser, error) {
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Parser{
+		Prefix:           prefix,
+		DefaultDomain:    defaultDomain,
+		ExposedByDefault: exposedByDefault,
+		Constraint:       c,
+	}, nil
+}
+
+// Label returns the full name of a label under the prefix of the parser.
+func (p *Parser) Label(name string) string {
+	return p.Prefix + "." + name
+}
+
+// Exposed reports whether the services of a container should be registered.
+func (p *Parser) Exposed(container Container) bool {
+	if !p.Constraint(container.Labels) {
+		return false
+	}
+
+	value, ok := container.Labels[p.Label(enableLabel)]
+	if !ok {
+		return p.ExposedByDefault
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.WithField("container", container.Name).Errorf("Fail to parse %s %s", p.Label(enableLabel), value)
+		return false
+	}
+	return enabled
+}
+
+// Services returns the services exposed by a container. Labels can be grouped
+// by name, like iplb.http.port and iplb.admin.port, to expose several services
+// from one container. The labels outside of any group are the defaults of
+// every group, except the port and the backend.
+func (p *Parser) Services(container Container) []models.Service {
+	services, errs := p.parse(container)
+	for _, err := range errs {
+		logrus.WithError(err).WithField("container", container.Name).Error("Fail to read labels")
+	}
+	return services
+}
+
+// ParseServices is Services failing on the first invalid label instead of
+// skipping its service, to validate the services given by users.
+func (p *Parser) ParseServices(container Container) ([]models.Service, error) {
+	services, errs := p.parse(container)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return services, nil
+}
+
+func (p *Parser) parse(container Container) ([]models.Service, []error) {
+	if !p.Exposed(container) {
+		return nil, nil
+	}
+
+	labels, err := p.labels(container)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	defaults := map[string]string{}
+	names := []string{}
+	for key, value := range labels {
+		segments := strings.Split(key, ".")
+		if contains(options, segments[0]) {
+			defaults[key] = value
+		} else if len(segments) == 2 && segments[1] == portLabel {
+			names = append(names, segments[0])
+		}
+	}
+	sort.Strings(names)
+
+	services := []models.Service{}
+	errs := []error{}
+	if service, err := ParseService(p.withDefaults(defaults, container, "")); err != nil {
+		errs = append(errs, err)
+	} else if service != nil {
+		service.Container = container.Name
+		service.Project = container.Project
+		services = append(services, *service)
+	}
+
+	for _, name := range names {
+		group := map[string]string{}
+		for key, value := range defaults {
+			if key != portLabel && key != backendLabel {
+				group[key] = value
+			}
+		}
+		groupPrefix := name + "."
+		for key, value := range labels {
+			if strings.HasPrefix(key, groupPrefix) {
+				group[strings.TrimPrefix(key, groupPrefix)] = value
+			}
+		}
+
+		if service, err := ParseService(p.withDefaults(group, container, name)); err != nil {
+			errs = append(errs, fmt.Errorf("group %s: %s", name, err))
+		} else if service != nil {
+			service.Name = name
+			service.Container = container.Name
+			service.Project = container.Project
+			services = append(services, *service)
+		}
+	}
+
+	return services, errs
+}
+
+// labels returns the labels under the prefix of the parser, without the
+// prefix, translated to the current schema version and with their templates
+// evaluated.
+func (p *Parser) labels(container Container) (map[string]string, error) {
+	prefix := p.Prefix + "."
+	labels := map[string]string{}
+	for key, value := range container.Labels {
+		if strings.HasPrefix(key, prefix) {
+			labels[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+
+	labels, err := translate(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range labels {
+		rendered, err := render(value, container)
+		if err != nil {
+			return nil, fmt.Errorf("fail to render label %s%s: %s", prefix, key, err)
+		}
+		labels[key] = rendered
+	}
+
+	return labels, nil
+}
+
+// withDefaults sets the backend of a service without one: the compose service
+// of the container, suffixed by the group name, so that the replicas of a
+// compose service share a backend. Without compose labels, the backend and
+// frontend rule default to the container name and a host name in the default
+// domain when configured. Services of a group get the group name as first
+// label of their host name. The labels are copied, being the defaults of the
+// groups.
+func (p *Parser) withDefaults(defaults map[string]string, container Container, group string) map[string]string {
+	if defaults[portLabel] == "" {
+		return defaults
+	}
+
+	labels := make(map[string]string, len(defaults)+2)
+	for key, value := range defaults {
+		labels[key] = value
+	}
+
+	if labels[backendLabel] == "" {
+		switch {
+		case container.Project != "" && container.Service != "":
+			labels[backendLabel] = container.Project + "_" + container.Service
+		case p.DefaultDomain != "":
+			labels[backendLabel] = container.Name
+		}
+		if labels[backendLabel] != "" && group != "" {
+			labels[backendLabel] += "_" + group
+		}
+	}
+
+	if labels[frontendLabel] == "" && p.DefaultDomain != "" {
+		labels[frontendLabel] = container.hostname(p.DefaultDomain)
+		if group != "" {
+			labels[frontendLabel] = hostLabel(group) + "." + labels[frontendLabel]
+		}
+	}
+
+	return labels
+}
+
+func Service(attributes map[string]string) *models.Service {
+	service, err := ParseService(attributes)
+	if err != nil {
+		logrus.WithError(err).Error("Fail to parse service labels")
+		return nil
+	}
+	return service
+}
+
+// ParseService builds a service from its labels, nil without port. The type
+// label makes it a TCP service, proxied without frontend rule from its
+// frontend port and probed by TCP by default. Control characters are only
+// allowed in the CA chain, the other labels being written on a single line of
+// a configuration.
+func ParseService(attributes map[string]string) (*models.Service, error) {
+	port := attributes[portLabel]
+	backend := attributes[backendLabel]
+	frontend := attributes[frontendLabel]
+	kind := attributes[typeLabel]
+	if port == "" {
+		return nil, nil
+	}
+	for key, value := range attributes {
+		if key != sslChainLabel && strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("invalid control character in label %s", key)
+		}
+	}
+	if kind == "" {
+		kind = serviceTypes[0]
+	}
+	if !contains(serviceTypes, kind) {
+		return nil, fmt.Errorf("unknown type %s for port %s", kind, port)
+	}
+	if kind == "tcp" {
+		if backend == "" || attributes[frontendPortLabel] == "" {
+			return nil, fmt.Errorf("a backend and a frontend port are required for TCP port %s", port)
+		}
+		frontend = ""
+	} else if backend == "" || frontend == "" {
+		return nil, fmt.Errorf("a backend and a frontend rule are required for port %s", port)
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s for frontend %s", port, frontend)
+	}
+	defaultType := defaultProbeType
+	if kind == "tcp" {
+		defaultType = "tcp"
+	}
+	probe, err := probeOf(attributes, defaultType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid probe for frontend %s: %s", frontend, err)
+	}
+	service := &models.Service{Frontend: frontend, Backend: backend, Port: portNum, Type: kind, Probe: probe}
+	if err := Link(attributes, service); err != nil {
+		return nil, fmt.Errorf("invalid link options for frontend %s: %s", frontend, err)
+	}
+	if err := Frontend(attributes, service); err != nil {
+		return nil, fmt.Errorf("invalid frontend options for frontend %s: %s", frontend, err)
+	}
+	return service, nil
+}
+
+// Probe builds the backend probe from the probe labels. Without any label the
+// links are checked with a plain HTTP probe, and the type "none" disables it.
+func Probe(attributes map[string]string) (*models.Probe, error) {
+	return probeOf(attributes, defaultProbeType)
+}
+
+// probeOf is Probe with the type of the probe without type label.
+func probeOf(attributes map[string]string, defaultType string) (*models.Probe, error) {
+	kind := attributes[probeTypeLabel]
+	if kind == "" {
+		kind = defaultType
+	}
+	if kind == noProbeType {
+		return nil, nil
+	}
+	if !contains(probeTypes, kind) {
+		return nil, fmt.Errorf("unknown probe type %s", kind)
+	}
+
+	probe := &models.Probe{
+		Type:   kind,
+		URL:    attributes[probeURLLabel],
+		Method: attributes[probeMethodLabel],
+	}
+	if kind != "http" && (probe.URL != "" || probe.Method != "") {
+		return nil, fmt.Errorf("probe url and method are only supported by http probes")
+	}
+	if probe.Method != "" && !contains(probeMethods, probe.Method) {
+		return nil, fmt.Errorf("unknown probe method %s", probe.Method)
+	}
+
+	status := attributes[probeStatusLabel]
+	regex := attributes[probeRegexLabel]
+	switch {
+	case status != "" && regex != "":
+		return nil, fmt.Errorf("probe status and regex are mutually exclusive")
+	case status != "":
+		if _, err := strconv.Atoi(status); err != nil {
+			return nil, fmt.Errorf("invalid probe status %s", status)
+		}
+		probe.Match = "status"
+		probe.Pattern = status
+	case regex != "":
+		if _, err := regexp.Compile(regex); err != nil {
+			return nil, fmt.Errorf("invalid probe regex %s: %s", regex, err)
+		}
+		probe.Match = "matches"
+		probe.Pattern = regex
+	}
+
+	if interval := attributes[probeIntervalLabel]; interval != "" {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid probe interval %s", interval)
+		}
+		probe.Interval = seconds
+	}
+
+	if negate := attributes[probeNegateLabel]; negate != "" {
+		value, err := strconv.ParseBool(negate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe negate %s", negate)
+		}
+		probe.Negate = value
+	}
+
+	return probe, nil
+}
+
+// Link sets the options of the link between the backend and this server:
+// weight, backup, proxy protocol, SSL to the backend and sticky cookie.
+func Link(attributes map[string]string, service *models.Service) error {
+	service.Weight = defaultWeight
+	if value := attributes[weightLabel]; value != "" {
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 || weight > maxWeight {
+			return fmt.Errorf("invalid weight %s", value)
+		}
+		service.Weight = weight
+	}
+
+	if value := attributes[backupLabel]; value != "" {
+		backup, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid backup %s", value)
+		}
+		service.Backup = backup
+	}
+
+	service.ProxyProtocol = attributes[proxyProtocolLabel]
+	if service.ProxyProtocol != "" && !contains(proxyProtocolVersions, service.ProxyProtocol) {
+		return fmt.Errorf("unknown proxy protocol version %s", service.ProxyProtocol)
+	}
+
+	if value := attributes[sslLabel]; value != "" {
+		ssl, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid ssl %s", value)
+		}
+		service.SSL = ssl
+	}
+
+	service.Chain = attributes[sslChainLabel]
+	if service.Chain != "" && !service.SSL {
+		return fmt.Errorf("a CA chain requires ssl to the backend")
+	}
+
+	service.Cookie = attributes[cookieLabel]
+
+	return nil
+}
+
+// Frontend sets the public port of the frontend, 80 or 443 with SSL unless
+// given, the sources allowed to reach it, as a comma separated list of IPs and
+// CIDRs, and the HTTP headers it adds to requests.
+func Frontend(attributes map[string]string, service *models.Service) error {
+	if value := attributes[frontendSSLLabel]; value != "" {
+		ssl, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid frontend ssl %s", value)
+		}
+		service.FrontendSSL = ssl
+	}
+
+	service.FrontendPort = defaultFrontendPort
+	if service.FrontendSSL {
+		service.FrontendPort = defaultFrontendSSLPort
+	}
+	if value := attributes[frontendPortLabel]; value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid frontend port %s", value)
+		}
+		service.FrontendPort = port
+	}
+
+	if value := attributes[allowLabel]; value != "" {
+		for _, source := range strings.Split(value, ",") {
+			source = strings.TrimSpace(source)
+			if source == "" {
+				continue
+			}
+			if !strings.Contains(source, "/") {
+				ip := net.ParseIP(source)
+				if ip == nil {
+					return fmt.Errorf("invalid allowed source %s", source)
+				}
+				if ip.To4() != nil {
+					source += "/32"
+				} else {
+					source += "/128"
+				}
+			}
+			_, block, err := net.ParseCIDR(source)
+			if err != nil {
+				return fmt.Errorf("invalid allowed source %s", source)
+			}
+			service.AllowedSource = append(service.AllowedSource, block.String())
+		}
+		sort.Strings(service.AllowedSource)
+	}
+
+	for key, value := range attributes {
+		if !strings.HasPrefix(key, headerLabelPrefix) {
+			continue
+		}
+		header := strings.TrimPrefix(key, headerLabelPrefix)
+		if header == "" || strings.ContainsAny(header, ": ") {
+			return fmt.Errorf("invalid header name %s", header)
+		}
+		service.HTTPHeader = append(service.HTTPHeader, fmt.Sprintf("%s: %s", header, value))
+	}
+	sort.Strings(service.HTTPHeader)
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
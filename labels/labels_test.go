@@ -0,0 +1,73 @@
+package labels
+
+import "testing"
+
+func TestGroupDefaults(t *testing.T) {
+	parser, err := NewParser("iplb", "example.com", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := NewContainer("1", "/shop_web_1", "shop/web", nil, map[string]string{
+		"com.docker.compose.project": "shop",
+		"com.docker.compose.service": "web",
+		"iplb.version":               "1",
+		"iplb.port":                  "8080",
+		"iplb.weight":                "50",
+		"iplb.admin.port":            "8081",
+	})
+
+	services, err := parser.ParseServices(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services, got %+v", services)
+	}
+
+	expected := []struct {
+		backend  string
+		frontend string
+		port     int
+	}{
+		{"shop_web", "web.shop.example.com", 8080},
+		{"shop_web_admin", "admin.web.shop.example.com", 8081},
+	}
+	for i, service := range services {
+		if service.Backend != expected[i].backend || service.Frontend != expected[i].frontend || service.Port != expected[i].port {
+			t.Errorf("expected %s on %s:%d, got %+v", expected[i].backend, expected[i].frontend, expected[i].port, service)
+		}
+		if service.Weight != 50 {
+			t.Errorf("expected the default weight of 50 in %s, got %d", service.Backend, service.Weight)
+		}
+	}
+}
+
+func TestParseServiceType(t *testing.T) {
+	db := map[string]string{"port": "5432", "backend": "app_db", "type": "tcp", "frontend.port": "5432", "frontend.rule": "db.example.com"}
+	service, err := ParseService(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Type != "tcp" || service.Frontend != "" || service.FrontendPort != 5432 || service.Probe == nil || service.Probe.Type != "tcp" {
+		t.Errorf("expected a TCP service probed by TCP without frontend rule, got %+v", service)
+	}
+
+	web := map[string]string{"port": "8080", "backend": "app_web", "frontend.rule": "web.example.com"}
+	if service, err := ParseService(web); err != nil || service.Type != "http" {
+		t.Errorf("expected an HTTP service by default, got %+v and %v", service, err)
+	}
+
+	invalid := []struct {
+		attributes map[string]string
+		err        string
+	}{
+		{map[string]string{"port": "5432", "backend": "app_db", "type": "udp", "frontend.port": "5432"}, "unknown type udp for port 5432"},
+		{map[string]string{"port": "5432", "backend": "app_db", "type": "tcp"}, "a backend and a frontend port are required for TCP port 5432"},
+		{map[string]string{"port": "8080", "backend": "app_web\nlisten evil", "frontend.rule": "web.example.com"}, "invalid control character in label backend"},
+	}
+	for _, test := range invalid {
+		if _, err := ParseService(test.attributes); err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package labels
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	versionLabel = "version"
+
+	// CurrentVersion is the version of the label names read by the parser.
+	CurrentVersion = 1
+)
+
+// upgrades translates the labels of a schema version to the next one: the
+// labels of version v are upgraded by upgrades[v]. Renaming a label means
+// bumping CurrentVersion and appending the translation of the old name here,
+// so that containers started with older labels keep being registered.
+var upgrades = []func(labels map[string]string) map[string]string{
+	upgradeV0,
+}
+
+// upgradeV0 translates the labels of the first agent, which registered a
+// service only with its port, backend and frontend rule, exposing it on a
+// frontend of the same port.
+func upgradeV0(labels map[string]string) map[string]string {
+	if labels[backendLabel] == "" || labels[frontendLabel] == "" {
+		delete(labels, portLabel)
+		return labels
+	}
+	if _, ok := labels[frontendPortLabel]; !ok && labels[portLabel] != "" {
+		labels[frontendPortLabel] = labels[portLabel]
+	}
+	return labels
+}
+
+// translate reads the schema version label, 0 when missing since the labels
+// of the first agent have no version, and upgrades the labels to the current
+// version.
+func translate(labels map[string]string) (map[string]string, error) {
+	version := 0
+	if value, ok := labels[versionLabel]; ok {
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid label schema version %s", value)
+		}
+		version = v
+	}
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("unsupported label schema version %d, the latest is %d", version, CurrentVersion)
+	}
+	delete(labels, versionLabel)
+
+	for v := version; v < CurrentVersion; v++ {
+		labels = upgrades[v](labels)
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,128 @@
+package labels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "version 0 by default",
+			labels:   map[string]string{"port": "423", "backend": "apish", "frontend.rule": "bim.example.com"},
+			expected: map[string]string{"port": "423", "backend": "apish", "frontend.rule": "bim.example.com", "frontend.port": "423"},
+		},
+		{
+			name:     "version 0 bare port ignored by default",
+			labels:   map[string]string{"port": "8080"},
+			expected: map[string]string{},
+		},
+		{
+			name:     "current version",
+			labels:   map[string]string{"version": "1", "port": "8080"},
+			expected: map[string]string{"port": "8080"},
+		},
+		{
+			name:     "v0 frontend on the port",
+			labels:   map[string]string{"version": "0", "port": "423", "backend": "apish", "frontend.rule": "bim.example.com"},
+			expected: map[string]string{"port": "423", "backend": "apish", "frontend.rule": "bim.example.com", "frontend.port": "423"},
+		},
+		{
+			name: "v0 frontend port kept",
+			labels: map[string]string{"version": "0", "port": "423", "backend": "apish", "frontend.rule": "bim.example.com",
+				"frontend.port": "80"},
+			expected: map[string]string{"port": "423", "backend": "apish", "frontend.rule": "bim.example.com", "frontend.port": "80"},
+		},
+		{
+			name:     "v0 bare port ignored",
+			labels:   map[string]string{"version": "0", "port": "423", "backend": "apish"},
+			expected: map[string]string{"backend": "apish"},
+		},
+		{
+			name:   "invalid version",
+			labels: map[string]string{"version": "one"},
+			err:    "invalid label schema version one",
+		},
+		{
+			name:   "negative version",
+			labels: map[string]string{"version": "-1"},
+			err:    "invalid label schema version -1",
+		},
+		{
+			name:   "future version",
+			labels: map[string]string{"version": "2"},
+			err:    "unsupported label schema version 2, the latest is 1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels, err := translate(test.labels)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, labels)
+			}
+		})
+	}
+}
+
+func TestReservedLabels(t *testing.T) {
+	parser, err := NewParser("iplb", "example.com", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := NewContainer("1", "/apish", "krkr/apish", nil, map[string]string{
+		"iplb.version":      "1",
+		"iplb.port":         "8080",
+		"iplb.enable.port":  "8081",
+		"iplb.version.port": "8082",
+	})
+
+	services, err := parser.ParseServices(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Port != 8080 || services[0].Name != "" {
+		t.Errorf("expected enable and version not to be groups, got %+v", services)
+	}
+}
+
+func TestUnversionedLabels(t *testing.T) {
+	parser, err := NewParser("iplb", "example.com", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A container of the first agent keeps its frontend on its port
+	container := NewContainer("1", "/apish", "krkr/apish", nil, map[string]string{
+		"iplb.port":          "423",
+		"iplb.backend":       "apish",
+		"iplb.frontend.rule": "bim.example.com",
+	})
+	services, err := parser.ParseServices(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Port != 423 || services[0].FrontendPort != 423 {
+		t.Errorf("expected the frontend on port 423, got %+v", services)
+	}
+
+	// The defaults of version 1 are not applied
+	container = NewContainer("2", "/bare", "krkr/apish", nil, map[string]string{"iplb.port": "8080"})
+	if services, err := parser.ParseServices(container); err != nil || len(services) != 0 {
+		t.Errorf("expected a bare port to be ignored, got %+v and %v", services, err)
+	}
+}
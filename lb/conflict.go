@@ -0,0 +1,110 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// FrontendKey identifies the frontend of a service, shared by the services
+// of its port.
+func FrontendKey(service models.Service) string {
+	return fmt.Sprintf("%s/%d", KindFrontend, service.FrontendPort)
+}
+
+// RouteKey identifies the route of the host of a service on its frontend.
+func RouteKey(service models.Service) string {
+	return fmt.Sprintf("%s/%d/%s", KindRoute, service.FrontendPort, strings.ToLower(service.Frontend))
+}
+
+// Conflicts returns the disagreements of the services: by frontend key, the
+// services sharing a frontend port with a different type, SSL, allowed
+// sources or HTTP headers, or a TCP port with different backends, and by
+// route key, the HTTP services routing the same host of a frontend to
+// different backends. Such a frontend or route is left untouched
+// until the services agree instead of being set by the last one, the
+// backends and links of the services being registered anyway.
+func Conflicts(services []models.Service) map[string]error {
+	conflicts := map[string]error{}
+	frontends := map[string]models.Service{}
+	routes := map[string]models.Service{}
+
+	for _, service := range services {
+		key := FrontendKey(service)
+		first, ok := frontends[key]
+		if !ok {
+			frontends[key] = service
+		} else if _, ok := conflicts[key]; !ok {
+			if err := frontendConflict(first, service); err != nil {
+				conflicts[key] = err
+			}
+		}
+
+		if ServiceType(service) == TypeTCP {
+			continue
+		}
+		key = RouteKey(service)
+		first, ok = routes[key]
+		if !ok {
+			routes[key] = service
+		} else if _, ok := conflicts[key]; !ok && first.Backend != service.Backend {
+			conflicts[key] = fmt.Errorf("host %s of frontend port %d is routed to backends %s and %s",
+				service.Frontend, service.FrontendPort, first.Backend, service.Backend)
+		}
+	}
+
+	return conflicts
+}
+
+// frontendConflict returns the first option of a frontend two services
+// disagree on.
+func frontendConflict(first models.Service, service models.Service) error {
+	switch {
+	case ServiceType(first) != ServiceType(service):
+		return fmt.Errorf("backends %s and %s share frontend port %d with types %s and %s",
+			first.Backend, service.Backend, service.FrontendPort, ServiceType(first), ServiceType(service))
+	case ServiceType(service) == TypeTCP && first.Backend != service.Backend:
+		return fmt.Errorf("backends %s and %s share TCP frontend port %d",
+			first.Backend, service.Backend, service.FrontendPort)
+	case first.FrontendSSL != service.FrontendSSL:
+		return fmt.Errorf("backends %s and %s share frontend port %d with and without SSL",
+			first.Backend, service.Backend, service.FrontendPort)
+	case !equalStrings(first.AllowedSource, service.AllowedSource):
+		return fmt.Errorf("backends %s and %s share frontend port %d with different allowed sources %v and %v",
+			first.Backend, service.Backend, service.FrontendPort, first.AllowedSource, service.AllowedSource)
+	case !equalStrings(first.HTTPHeader, service.HTTPHeader):
+		return fmt.Errorf("backends %s and %s share frontend port %d with different HTTP headers %v and %v",
+			first.Backend, service.Backend, service.FrontendPort, first.HTTPHeader, service.HTTPHeader)
+	}
+	return nil
+}
+
+// Conflict returns the conflict of the frontend or route of a service, empty
+// without any.
+func Conflict(plan *models.Plan, service models.Service) string {
+	if conflict := plan.Conflicts[FrontendKey(service)]; conflict != "" {
+		return conflict
+	}
+	return plan.Conflicts[RouteKey(service)]
+}
+
+// equalStrings compares two lists regardless of their order.
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := map[string]int{}
+	for _, value := range a {
+		counts[value]++
+	}
+	for _, value := range b {
+		if counts[value] == 0 {
+			return false
+		}
+		counts[value]--
+	}
+
+	return true
+}
@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// LoadBalancer is a target the services are registered in, like the OVH IPLB.
+type LoadBalancer interface {
+	// Snapshot reads the current configuration of the load balancer.
+	Snapshot() (*models.State, error)
+	// Plan returns the changes registering the services in a configuration.
+	Plan(state *models.State, services []models.Service) *models.Plan
+	// Apply makes the changes of a plan, in order.
+	Apply(plan *models.Plan) error
+
+	GetServers() ([]models.Server, error)
+	GetBackends() ([]models.Backend, error)
+	GetFrontends() ([]models.Frontend, error)
+	GetRoutes() ([]models.Route, error)
+	GetLinksByBackendID(backendID int) ([]models.Link, error)
+}
+
+// Checker is a load balancer able to check it is reachable with valid
+// credentials, like the OVH API.
+type Checker interface {
+	Check() error
+}
+
+// Sync registers the services in a load balancer and returns the plan it
+// applied.
+func Sync(target LoadBalancer, services []models.Service) (*models.Plan, error) {
+	logrus.Infof("Sync %d services", len(services))
+
+	state, err := target.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return syncState(target, state, services)
+}
+
+// syncState registers the services in a load balancer from a snapshot of its
+// state.
+func syncState(target LoadBalancer, state *models.State, services []models.Service) (*models.Plan, error) {
+	plan := target.Plan(state, services)
+	for key, conflict := range plan.Conflicts {
+		logrus.WithField("key", key).Error("Skip conflicting " + strings.SplitN(key, "/", 2)[0] + ": " + conflict)
+	}
+
+	if err := target.Apply(plan); err != nil {
+		return plan, err
+	}
+
+	logrus.Infof("Sync done with %d changes", len(plan.Changes))
+	return plan, nil
+}
+
+// ApplyError is the failure of a change of a plan, the previous ones being
+// applied.
+type ApplyError struct {
+	Index  int
+	Change models.Change
+	Err    error
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("fail to %s %s of backend %s: %s", e.Change.Action, e.Change.Kind, e.Change.Service.Backend, e.Err)
+}
@@ -0,0 +1,339 @@
+package lb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// Memory is a load balancer keeping its state in memory, the base of the
+// targets rendering it elsewhere. Unlike the IPLB, whose objects may be
+// managed by hand, it owns its whole state: the objects the services of a
+// plan no longer need are removed when it is applied.
+type Memory struct {
+	Address string
+	Zone    string
+
+	mu     sync.Mutex
+	state  models.State
+	lastID int
+}
+
+func NewMemory(address string, zone string) *Memory {
+	return &Memory{
+		Address: address,
+		Zone:    zone,
+		state: models.State{
+			Address: address,
+			Zone:    zone,
+			Links:   map[int][]models.Link{},
+		},
+	}
+}
+
+func (m *Memory) Snapshot() (*models.State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.state
+	state.Servers = append([]models.Server{}, m.state.Servers...)
+	state.Backends = append([]models.Backend{}, m.state.Backends...)
+	state.Frontends = append([]models.Frontend{}, m.state.Frontends...)
+	state.Routes = make([]models.Route, len(m.state.Routes))
+	for i, route := range m.state.Routes {
+		route.Rules = append([]models.RouteRule{}, route.Rules...)
+		state.Routes[i] = route
+	}
+	state.Links = make(map[int][]models.Link, len(m.state.Links))
+	for backendID, links := range m.state.Links {
+		state.Links[backendID] = append([]models.Link{}, links...)
+	}
+
+	return &state, nil
+}
+
+// Plan returns the changes of the IPLB.
+func (m *Memory) Plan(state *models.State, services []models.Service) *models.Plan {
+	return Diff(state, services)
+}
+
+// Apply makes the changes of a plan in the state.
+func (m *Memory) Apply(plan *models.Plan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, change := range plan.Changes {
+		service := change.Service
+		if service.Address == "" {
+			service.Address = m.Address
+		}
+
+		switch change.Kind {
+
+		case KindServer:
+			m.state.Servers = append(m.state.Servers, models.Server{
+				ID:      m.nextID(),
+				Address: service.Address,
+				Status:  "active",
+				Zone:    m.Zone,
+			})
+
+		case KindBackend:
+			if change.Action == ActionAdd {
+				backend := NewBackend(service, m.Zone)
+				m.state.Backends = append(m.state.Backends, models.Backend{
+					ID:    m.nextID(),
+					Name:  backend.Name,
+					Port:  backend.Port,
+					Type:  backend.Type,
+					Zone:  backend.Zone,
+					Probe: backend.Probe,
+				})
+				continue
+			}
+			for i := range m.state.Backends {
+				if m.state.Backends[i].ID == change.ID {
+					m.state.Backends[i].Name = service.Backend
+					m.state.Backends[i].Probe = service.Probe
+				}
+			}
+
+		case KindFrontend:
+			backendID := 0
+			if backend := FindBackend(&m.state, service.Backend); backend != nil {
+				backendID = backend.ID
+			}
+			if change.Action == ActionAdd {
+				frontend := NewFrontend(service, m.Zone, backendID)
+				m.state.Frontends = append(m.state.Frontends, models.Frontend{
+					ID:               m.nextID(),
+					AllowedSource:    frontend.AllowedSource,
+					DefaultBackendID: frontend.DefaultBackendID,
+					HTTPHeader:       frontend.HTTPHeader,
+					Port:             strconv.Itoa(frontend.Port),
+					SSL:              frontend.SSL,
+					Zone:             frontend.Zone,
+				})
+				continue
+			}
+			update := FrontendUpdate(service, backendID)
+			for i := range m.state.Frontends {
+				if m.state.Frontends[i].ID == change.ID {
+					m.state.Frontends[i].AllowedSource = update.AllowedSource
+					m.state.Frontends[i].DefaultBackendID = update.DefaultBackendID
+					m.state.Frontends[i].HTTPHeader = update.HTTPHeader
+					m.state.Frontends[i].Port = update.Port
+					m.state.Frontends[i].SSL = update.SSL
+				}
+			}
+
+		case KindRoute:
+			backend := FindBackend(&m.state, service.Backend)
+			frontend := FindFrontend(&m.state, service.FrontendPort)
+			if backend == nil || frontend == nil {
+				return fmt.Errorf("fail to route host %s to unknown backend %s or frontend port %d",
+					service.Frontend, service.Backend, service.FrontendPort)
+			}
+			rule := NewRouteRule(service)
+			rules := []models.RouteRule{{ID: m.nextID(), Field: rule.Field, Match: rule.Match, Pattern: rule.Pattern}}
+			if change.Action == ActionAdd {
+				m.state.Routes = append(m.state.Routes, models.Route{
+					ID:         m.nextID(),
+					BackendID:  backend.ID,
+					FrontendID: frontend.ID,
+					Rules:      rules,
+				})
+				continue
+			}
+			for i := range m.state.Routes {
+				if m.state.Routes[i].ID == change.ID {
+					m.state.Routes[i].BackendID = backend.ID
+					if len(m.state.Routes[i].Rules) == 0 {
+						m.state.Routes[i].Rules = rules
+					}
+				}
+			}
+
+		case KindLink:
+			if change.Action == ActionAdd {
+				backend := FindBackend(&m.state, service.Backend)
+				server := FindServer(&m.state, service.Address)
+				if backend == nil || server == nil {
+					return fmt.Errorf("fail to add link of backend %s to unknown server %s", service.Backend, service.Address)
+				}
+				link := NewLink(service, server.ID)
+				m.state.Links[backend.ID] = append(m.state.Links[backend.ID], models.Link{
+					ID:                   m.nextID(),
+					Backup:               link.Backup,
+					Chain:                link.Chain,
+					Cookie:               link.Cookie,
+					Port:                 link.Port,
+					Probe:                link.Probe,
+					ProxyProtocolVersion: link.ProxyProtocolVersion,
+					ServerID:             link.ServerID,
+					SSL:                  link.SSL,
+					Weight:               link.Weight,
+				})
+				continue
+			}
+			update := LinkUpdate(service)
+			links := m.state.Links[change.BackendID]
+			for i := range links {
+				if links[i].ID == change.ID {
+					links[i].Backup = update.Backup
+					links[i].Chain = update.Chain
+					links[i].Cookie = update.Cookie
+					links[i].Probe = update.Probe
+					links[i].ProxyProtocolVersion = update.ProxyProtocolVersion
+					links[i].SSL = update.SSL
+					links[i].Weight = update.Weight
+				}
+			}
+		}
+	}
+
+	m.prune(plan)
+	return nil
+}
+
+// prune removes the links, backends, routes, frontends and servers not needed
+// by the services of a plan, except the frontends and routes left as is
+// while their services disagree.
+func (m *Memory) prune(plan *models.Plan) {
+	backends := map[string]bool{}
+	links := map[string]bool{}
+	ports := map[string]bool{}
+	routes := map[string]bool{}
+	for _, service := range plan.Services {
+		if service.Address == "" {
+			service.Address = m.Address
+		}
+		backends[service.Backend] = true
+		links[fmt.Sprintf("%s/%s:%d", service.Backend, service.Address, service.Port)] = true
+		ports[strconv.Itoa(service.FrontendPort)] = true
+		routes[fmt.Sprintf("%d/%s/%s", service.FrontendPort, strings.ToLower(service.Frontend), service.Backend)] = true
+	}
+	for key := range plan.Conflicts {
+		parts := strings.SplitN(key, "/", 3)
+		if parts[0] == KindFrontend {
+			ports[parts[1]] = true
+		}
+	}
+
+	servers := map[int]models.Server{}
+	for _, server := range m.state.Servers {
+		servers[server.ID] = server
+	}
+
+	kept := []models.Backend{}
+	names := map[int]string{}
+	for _, backend := range m.state.Backends {
+		if !backends[backend.Name] {
+			delete(m.state.Links, backend.ID)
+			continue
+		}
+		kept = append(kept, backend)
+		names[backend.ID] = backend.Name
+
+		backendLinks := []models.Link{}
+		for _, link := range m.state.Links[backend.ID] {
+			if links[fmt.Sprintf("%s/%s:%d", backend.Name, servers[link.ServerID].Address, link.Port)] {
+				backendLinks = append(backendLinks, link)
+			}
+		}
+		m.state.Links[backend.ID] = backendLinks
+	}
+	m.state.Backends = kept
+
+	frontends := []models.Frontend{}
+	frontendPorts := map[int]string{}
+	for _, frontend := range m.state.Frontends {
+		if ports[frontend.Port] {
+			frontends = append(frontends, frontend)
+			frontendPorts[frontend.ID] = frontend.Port
+		}
+	}
+	m.state.Frontends = frontends
+
+	keptRoutes := []models.Route{}
+	for _, route := range m.state.Routes {
+		port, ok := frontendPorts[route.FrontendID]
+		name, found := names[route.BackendID]
+		if !ok || !found {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", port, strings.ToLower(RouteHost(&route)))
+		_, conflicting := plan.Conflicts[KindFrontend+"/"+port]
+		if _, ok := plan.Conflicts[KindRoute+"/"+key]; ok {
+			conflicting = true
+		}
+		if conflicting || routes[key+"/"+name] {
+			keptRoutes = append(keptRoutes, route)
+		}
+	}
+	m.state.Routes = keptRoutes
+
+	used := map[int]bool{}
+	for _, backendLinks := range m.state.Links {
+		for _, link := range backendLinks {
+			used[link.ServerID] = true
+		}
+	}
+	keptServers := []models.Server{}
+	for _, server := range m.state.Servers {
+		if used[server.ID] {
+			keptServers = append(keptServers, server)
+		}
+	}
+	m.state.Servers = keptServers
+}
+
+func (m *Memory) nextID() int {
+	m.lastID++
+	return m.lastID
+}
+
+// Read views
+
+func (m *Memory) GetServers() ([]models.Server, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return state.Servers, nil
+}
+
+func (m *Memory) GetBackends() ([]models.Backend, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return state.Backends, nil
+}
+
+func (m *Memory) GetFrontends() ([]models.Frontend, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return state.Frontends, nil
+}
+
+func (m *Memory) GetRoutes() ([]models.Route, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return state.Routes, nil
+}
+
+func (m *Memory) GetLinksByBackendID(backendID int) ([]models.Link, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return state.Links[backendID], nil
+}
@@ -0,0 +1,353 @@
+package lb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+
+	KindServer   = "server"
+	KindBackend  = "backend"
+	KindFrontend = "frontend"
+	KindRoute    = "route"
+	KindLink     = "link"
+
+	// TypeHTTP services are routed by host, TypeTCP ones by port.
+	TypeHTTP = "http"
+	TypeTCP  = "tcp"
+
+	hostField = "host"
+	hostMatch = "is"
+)
+
+// Diff returns the changes registering the services in the configuration of a
+// load balancer modelled like the IPLB: a server by address, a backend by
+// name, a frontend by port shared by its services, a route by frontend and
+// host to the backend of its services, and a link by backend, server and
+// port. Each object is added or updated once, by the first service requiring
+// it.
+func Diff(state *models.State, services []models.Service) *models.Plan {
+	plan := &models.Plan{State: state, Services: services, Changes: []models.Change{}, Conflicts: map[string]string{}}
+
+	conflicts := Conflicts(services)
+	for key, err := range conflicts {
+		plan.Conflicts[key] = err.Error()
+	}
+
+	planned := map[string]bool{}
+	change := func(key string, c models.Change) {
+		if !planned[key] {
+			planned[key] = true
+			plan.Changes = append(plan.Changes, c)
+		}
+	}
+	adopted := map[int]string{}
+
+	for _, service := range services {
+		if service.Address == "" {
+			service.Address = state.Address
+		}
+
+		// Server
+
+		server := FindServer(state, service.Address)
+		if server == nil {
+			change(KindServer+"/"+service.Address, models.Change{Action: ActionAdd, Kind: KindServer, Service: service})
+		}
+
+		// Backend
+
+		backend := FindBackend(state, service.Backend)
+		if backend == nil {
+			// Adopt the backend of the port created before backends were named
+			unnamed := FindUnnamedBackend(state, service.Port)
+			if unnamed != nil && (adopted[unnamed.ID] == "" || adopted[unnamed.ID] == service.Backend) {
+				adopted[unnamed.ID] = service.Backend
+				backend = unnamed
+				change(KindBackend+"/"+service.Backend, models.Change{Action: ActionUpdate, Kind: KindBackend, ID: backend.ID, Service: service})
+			}
+		}
+		if backend == nil {
+			change(KindBackend+"/"+service.Backend, models.Change{Action: ActionAdd, Kind: KindBackend, Service: service})
+		} else if !ProbeMatches(backend.Probe, service.Probe) {
+			change(KindBackend+"/"+service.Backend, models.Change{Action: ActionUpdate, Kind: KindBackend, ID: backend.ID, Service: service})
+		}
+
+		// Link
+
+		var link *models.Link
+		if backend != nil && server != nil {
+			link = FindLink(state, backend.ID, server.ID, service.Port)
+		}
+		key := fmt.Sprintf("%s/%s/%s:%d", KindLink, service.Backend, service.Address, service.Port)
+		if link == nil {
+			change(key, models.Change{Action: ActionAdd, Kind: KindLink, Service: service})
+		} else if !LinkMatches(link, LinkUpdate(service)) {
+			change(key, models.Change{Action: ActionUpdate, Kind: KindLink, ID: link.ID, BackendID: backend.ID, Service: service})
+		}
+
+		// Frontend, left as is with its routes while its services disagree
+
+		key = FrontendKey(service)
+		if _, ok := conflicts[key]; ok {
+			continue
+		}
+		backendID := 0
+		if backend != nil {
+			backendID = backend.ID
+		}
+		frontend := FindFrontend(state, service.FrontendPort)
+		if frontend == nil {
+			change(key, models.Change{Action: ActionAdd, Kind: KindFrontend, Service: service})
+		} else if !FrontendMatches(frontend, service, backendID) {
+			change(key, models.Change{Action: ActionUpdate, Kind: KindFrontend, ID: frontend.ID, Service: service})
+		}
+
+		// Route, the TCP services using the default backend of their frontend
+
+		if ServiceType(service) == TypeTCP {
+			continue
+		}
+
+		key = RouteKey(service)
+		if _, ok := conflicts[key]; ok {
+			continue
+		}
+		var route *models.Route
+		if frontend != nil {
+			route = FindRoute(state, frontend.ID, service.Frontend)
+			if route == nil && backend != nil {
+				// Complete the route whose host rule failed to be added
+				route = FindUnruledRoute(state, frontend.ID, backend.ID)
+			}
+		}
+		if route == nil {
+			change(key, models.Change{Action: ActionAdd, Kind: KindRoute, Service: service})
+		} else if backend == nil || route.BackendID != backend.ID || len(route.Rules) == 0 {
+			change(key, models.Change{Action: ActionUpdate, Kind: KindRoute, ID: route.ID, Service: service})
+		}
+	}
+
+	return plan
+}
+
+func FindServer(state *models.State, address string) *models.Server {
+	for i := range state.Servers {
+		if state.Servers[i].Address == address {
+			return &state.Servers[i]
+		}
+	}
+	return nil
+}
+
+func FindBackend(state *models.State, name string) *models.Backend {
+	for i := range state.Backends {
+		if state.Backends[i].Name == name && state.Backends[i].Zone == state.Zone {
+			return &state.Backends[i]
+		}
+	}
+	return nil
+}
+
+func FindUnnamedBackend(state *models.State, port int) *models.Backend {
+	for i := range state.Backends {
+		if state.Backends[i].Name == "" && state.Backends[i].Port == port && state.Backends[i].Zone == state.Zone {
+			return &state.Backends[i]
+		}
+	}
+	return nil
+}
+
+func FindFrontend(state *models.State, port int) *models.Frontend {
+	for i := range state.Frontends {
+		if state.Frontends[i].Port == strconv.Itoa(port) && state.Frontends[i].Zone == state.Zone {
+			return &state.Frontends[i]
+		}
+	}
+	return nil
+}
+
+// FindRoute returns the route of a host on a frontend.
+func FindRoute(state *models.State, frontendID int, host string) *models.Route {
+	for i := range state.Routes {
+		if state.Routes[i].FrontendID == frontendID && strings.EqualFold(RouteHost(&state.Routes[i]), host) {
+			return &state.Routes[i]
+		}
+	}
+	return nil
+}
+
+// FindUnruledRoute returns a route of a frontend to a backend without rule.
+func FindUnruledRoute(state *models.State, frontendID int, backendID int) *models.Route {
+	for i := range state.Routes {
+		route := &state.Routes[i]
+		if route.FrontendID == frontendID && route.BackendID == backendID && len(route.Rules) == 0 {
+			return route
+		}
+	}
+	return nil
+}
+
+// RouteHost returns the host matched by a route, empty when it matches
+// anything else.
+func RouteHost(route *models.Route) string {
+	if len(route.Rules) != 1 || route.Rules[0].Field != hostField || route.Rules[0].Match != hostMatch {
+		return ""
+	}
+	return route.Rules[0].Pattern
+}
+
+func FindLink(state *models.State, backendID int, serverID int, port int) *models.Link {
+	links := state.Links[backendID]
+	for i := range links {
+		if links[i].ServerID == serverID && links[i].Port == port {
+			return &links[i]
+		}
+	}
+	return nil
+}
+
+// ServiceType returns the type of a service, HTTP by default.
+func ServiceType(service models.Service) string {
+	if service.Type == "" {
+		return TypeHTTP
+	}
+	return service.Type
+}
+
+// NewBackend returns the backend of a service.
+func NewBackend(service models.Service, zone string) *models.AddBackend {
+	return &models.AddBackend{Name: service.Backend, Port: service.Port, Type: ServiceType(service), Zone: zone, Probe: service.Probe}
+}
+
+// NewFrontend returns the frontend of the port of a service, whose backend is
+// the default one of the frontend for a TCP service.
+func NewFrontend(service models.Service, zone string, backendID int) *models.AddFrontend {
+	frontend := &models.AddFrontend{
+		AllowedSource: service.AllowedSource,
+		HTTPHeader:    service.HTTPHeader,
+		Port:          service.FrontendPort,
+		SSL:           service.FrontendSSL,
+		Zone:          zone,
+	}
+	if ServiceType(service) == TypeTCP {
+		frontend.DefaultBackendID = backendID
+	}
+	return frontend
+}
+
+// NewRouteRule returns the rule routing the host of a service.
+func NewRouteRule(service models.Service) *models.AddRouteRule {
+	return &models.AddRouteRule{Field: hostField, Match: hostMatch, Pattern: service.Frontend}
+}
+
+// FrontendUpdate returns the options of the frontend of a service.
+func FrontendUpdate(service models.Service, backendID int) *models.UpdateFrontend {
+	update := &models.UpdateFrontend{
+		AllowedSource: service.AllowedSource,
+		HTTPHeader:    service.HTTPHeader,
+		Port:          strconv.Itoa(service.FrontendPort),
+		SSL:           service.FrontendSSL,
+	}
+	if ServiceType(service) == TypeTCP {
+		update.DefaultBackendID = backendID
+	}
+	return update
+}
+
+// NewLink returns the link of a service to its server.
+func NewLink(service models.Service, serverID int) *models.AddLink {
+	update := LinkUpdate(service)
+	return &models.AddLink{
+		Backup:               update.Backup,
+		Chain:                update.Chain,
+		Cookie:               update.Cookie,
+		Port:                 service.Port,
+		Probe:                update.Probe,
+		ProxyProtocolVersion: update.ProxyProtocolVersion,
+		ServerID:             serverID,
+		SSL:                  update.SSL,
+		Weight:               update.Weight,
+	}
+}
+
+// LinkUpdate returns the options of the link of a service.
+func LinkUpdate(service models.Service) *models.UpdateLink {
+	return &models.UpdateLink{
+		Backup:               service.Backup,
+		Chain:                service.Chain,
+		Cookie:               service.Cookie,
+		Probe:                service.Probe != nil,
+		ProxyProtocolVersion: service.ProxyProtocol,
+		SSL:                  service.SSL,
+		Weight:               service.Weight,
+	}
+}
+
+// Defaults of the IPLB for the fields left empty in a probe.
+const (
+	defaultProbeMethod   = "GET"
+	defaultProbeURL      = "/"
+	defaultProbeMatch    = "default"
+	defaultProbeInterval = 30
+)
+
+// NormalizeProbe returns a probe with its empty fields set to the defaults of
+// the IPLB, nil when the links are not probed.
+func NormalizeProbe(probe *models.Probe) *models.Probe {
+	if probe == nil {
+		return nil
+	}
+	normalized := *probe
+	if normalized.Type == "http" {
+		if normalized.Method == "" {
+			normalized.Method = defaultProbeMethod
+		}
+		if normalized.URL == "" {
+			normalized.URL = defaultProbeURL
+		}
+	}
+	if normalized.Match == "" {
+		normalized.Match = defaultProbeMatch
+		normalized.Pattern = ""
+	}
+	if normalized.Interval == 0 {
+		normalized.Interval = defaultProbeInterval
+	}
+	return &normalized
+}
+
+// ProbeMatches reports whether the current probe of a backend is the desired
+// one, nil when the links are not probed. Both are normalized, the IPLB
+// filling the empty fields with its defaults, so that removing a probe label
+// restores the default of its field.
+func ProbeMatches(current *models.Probe, desired *models.Probe) bool {
+	if current == nil || desired == nil {
+		return current == desired
+	}
+	return *NormalizeProbe(current) == *NormalizeProbe(desired)
+}
+
+func FrontendMatches(frontend *models.Frontend, service models.Service, backendID int) bool {
+	return frontend.Port == strconv.Itoa(service.FrontendPort) &&
+		(ServiceType(service) != TypeTCP || frontend.DefaultBackendID == backendID) &&
+		frontend.SSL == service.FrontendSSL &&
+		equalStrings(frontend.AllowedSource, service.AllowedSource) &&
+		equalStrings(frontend.HTTPHeader, service.HTTPHeader)
+}
+
+func LinkMatches(link *models.Link, desired *models.UpdateLink) bool {
+	return link.Backup == desired.Backup &&
+		link.Chain == desired.Chain &&
+		link.Cookie == desired.Cookie &&
+		link.Probe == desired.Probe &&
+		link.ProxyProtocolVersion == desired.ProxyProtocolVersion &&
+		link.SSL == desired.SSL &&
+		link.Weight == desired.Weight
+}
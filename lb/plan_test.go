@@ -0,0 +1,51 @@
+package lb_test
+
+import (
+	"testing"
+
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+func TestDiffProbe(t *testing.T) {
+	probed := models.Probe{Type: "http", URL: "/health", Method: "HEAD", Match: "status", Pattern: "200", Interval: 10}
+	matching := models.Probe{Type: "http", URL: "/health", Method: "HEAD", Match: "matches", Pattern: "ok", Interval: 10}
+
+	tests := []struct {
+		name    string
+		current models.Probe
+		desired models.Probe
+		update  bool
+	}{
+		{"unchanged", probed, probed, false},
+		{"url removed", probed, models.Probe{Type: "http", Method: "HEAD", Match: "status", Pattern: "200", Interval: 10}, true},
+		{"method removed", probed, models.Probe{Type: "http", URL: "/health", Match: "status", Pattern: "200", Interval: 10}, true},
+		{"status removed", probed, models.Probe{Type: "http", URL: "/health", Method: "HEAD", Interval: 10}, true},
+		{"regex removed", matching, models.Probe{Type: "http", URL: "/health", Method: "HEAD", Interval: 10}, true},
+		{"interval removed", probed, models.Probe{Type: "http", URL: "/health", Method: "HEAD", Match: "status", Pattern: "200"}, true},
+		{"defaults filled by the IPLB", models.Probe{Type: "http", URL: "/", Method: "GET", Match: "default", Interval: 30}, models.Probe{Type: "http"}, false},
+		{"defaults given", models.Probe{Type: "tcp"}, models.Probe{Type: "tcp", Match: "default", Interval: 30}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current, desired := test.current, test.desired
+			service := models.Service{Frontend: "bim.example.com", Backend: "app_bim", Port: 32768, Weight: 100, FrontendPort: 80, Probe: &current}
+			memory := lb.NewMemory("10.0.0.1", "all")
+			if _, err := lb.Sync(memory, []models.Service{service}); err != nil {
+				t.Fatal(err)
+			}
+
+			service.Probe = &desired
+			state, err := memory.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan := lb.Diff(state, []models.Service{service})
+			updated := len(plan.Changes) == 1 && plan.Changes[0].Kind == lb.KindBackend && plan.Changes[0].Action == lb.ActionUpdate
+			if updated != test.update || (!test.update && len(plan.Changes) != 0) {
+				t.Errorf("expected the backend to be updated: %v, got %+v", test.update, plan.Changes)
+			}
+		})
+	}
+}
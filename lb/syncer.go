@@ -0,0 +1,227 @@
+package lb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/metrics"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const (
+	StatusRegistered = "registered"
+	StatusConflict   = "conflict"
+	StatusFailed     = "failed"
+)
+
+// Syncer syncs the services in a load balancer periodically or on demand,
+// one sync at a time, and keeps the status of the last one.
+type Syncer struct {
+	Target   LoadBalancer
+	Services func() []models.Service
+
+	started  time.Time
+	syncLock sync.Mutex
+	// applied is the services of the last successful sync, nil after a
+	// failure.
+	applied []models.Service
+
+	status     models.SyncStatus
+	statusLock sync.Mutex
+}
+
+func NewSyncer(target LoadBalancer, services func() []models.Service) *Syncer {
+	return &Syncer{Target: target, Services: services, started: time.Now()}
+}
+
+// Run syncs the services every interval until stop is closed.
+func (s *Syncer) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Sync syncs the services now and returns its status.
+func (s *Syncer) Sync() models.SyncStatus {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	services := s.Services()
+	start := time.Now()
+	logrus.Infof("Sync %d services", len(services))
+
+	var plan *models.Plan
+	state, err := s.Target.Snapshot()
+	if err == nil {
+		s.observeDrift(state)
+		plan, err = syncState(s.Target, state, services)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Fail to sync services")
+		s.applied = nil
+	} else {
+		s.applied = append([]models.Service{}, services...)
+	}
+
+	duration := time.Since(start)
+	observe(err, duration)
+
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	status := models.SyncStatus{
+		Time:        start,
+		Duration:    duration.String(),
+		LastSuccess: s.status.LastSuccess,
+		Services:    results(services, plan, err),
+	}
+	if plan != nil {
+		status.Changes = len(plan.Changes)
+	}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.LastSuccess = start
+	}
+	s.status = status
+	metrics.OwnedLinks.Set(float64(ownedLinks(status.Services)))
+
+	return status
+}
+
+// observe records the result and duration of a sync.
+func observe(err error, duration time.Duration) {
+	metrics.SyncDuration.Observe(duration.Seconds())
+	if err != nil {
+		metrics.SyncRuns.WithLabelValues("failure").Inc()
+	} else {
+		metrics.SyncRuns.WithLabelValues("success").Inc()
+	}
+}
+
+// observeDrift records the changes made to the load balancer since the last
+// successful sync: those bringing it back to the services then applied. The
+// changes of the services themselves are no drift.
+func (s *Syncer) observeDrift(state *models.State) {
+	if s.applied == nil {
+		return
+	}
+	for _, change := range s.Target.Plan(state, s.applied).Changes {
+		metrics.Drift.WithLabelValues(change.Action, change.Kind).Inc()
+	}
+}
+
+// ownedLinks returns the number of links of the registered services.
+func ownedLinks(results []models.ServiceResult) int {
+	links := map[string]bool{}
+	for _, result := range results {
+		if result.Status == StatusRegistered {
+			service := result.Service
+			links[fmt.Sprintf("%s/%s:%d", service.Backend, service.Address, service.Port)] = true
+		}
+	}
+	return len(links)
+}
+
+// SinceSuccess returns the time since the last successful sync, since the
+// creation of the syncer when none succeeded yet.
+func (s *Syncer) SinceSuccess() time.Duration {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.status.LastSuccess.IsZero() {
+		return time.Since(s.started)
+	}
+	return time.Since(s.status.LastSuccess)
+}
+
+// Status returns the status of the last sync.
+func (s *Syncer) Status() models.SyncStatus {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	return s.status
+}
+
+// Plan returns the changes the next sync would make.
+func (s *Syncer) Plan() (*models.Plan, error) {
+	state, err := s.Target.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Target.Plan(state, s.Services()), nil
+}
+
+// results returns the result of each service of a sync. When a change fails,
+// the services needing it or a following change are failed.
+func results(services []models.Service, plan *models.Plan, err error) []models.ServiceResult {
+	var unapplied []models.Change
+	if plan != nil {
+		unapplied = plan.Changes
+		if applyErr, ok := err.(*ApplyError); ok {
+			unapplied = plan.Changes[applyErr.Index:]
+		} else if err == nil {
+			unapplied = nil
+		}
+	}
+
+	results := make([]models.ServiceResult, len(services))
+	for i, service := range services {
+		result := models.ServiceResult{Service: service, Status: StatusRegistered}
+
+		switch {
+		case plan == nil:
+			result.Status = StatusFailed
+			result.Error = err.Error()
+
+		case Conflict(plan, service) != "":
+			result.Status = StatusConflict
+			result.Error = Conflict(plan, service)
+
+		default:
+			address := service.Address
+			if address == "" && plan.State != nil {
+				address = plan.State.Address
+			}
+			for _, change := range unapplied {
+				if needs(service, address, change) {
+					result.Status = StatusFailed
+					result.Error = err.Error()
+					break
+				}
+			}
+		}
+
+		results[i] = result
+	}
+
+	return results
+}
+
+// needs reports whether a change is required to register a service.
+func needs(service models.Service, address string, change models.Change) bool {
+	switch change.Kind {
+	case KindServer:
+		return change.Service.Address == address
+	case KindFrontend:
+		return FrontendKey(change.Service) == FrontendKey(service)
+	case KindRoute:
+		return RouteKey(change.Service) == RouteKey(service)
+	case KindLink:
+		return change.Service.Backend == service.Backend && change.Service.Address == address &&
+			change.Service.Port == service.Port
+	default:
+		return change.Service.Backend == service.Backend
+	}
+}
@@ -0,0 +1,104 @@
+package lb_test
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/thbkrkr/iplb-docker/iplb"
+	"github.com/thbkrkr/iplb-docker/iplb/iplbtest"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/metrics"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+func TestSyncerStatus(t *testing.T) {
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &iplb.IPLB{ServiceName: server.ServiceName, Address: "10.0.0.1", Client: client}
+
+	services := []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: 32768, Weight: 100, FrontendPort: 80},
+		{Frontend: "api.example.com", Backend: "app_api", Port: 8080, Weight: 100, FrontendPort: 8080},
+		{Frontend: "bam.example.com", Backend: "app_bam", Port: 8081, Weight: 100, FrontendPort: 8080,
+			AllowedSource: []string{"10.0.0.0/8"}},
+	}
+	syncer := lb.NewSyncer(target, func() []models.Service { return services })
+
+	plan, err := syncer.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 9 || plan.Conflicts["frontend/8080"] == "" {
+		t.Fatalf("expected all the changes but the frontend of port 8080, got %+v", plan)
+	}
+
+	// The first frontend fails, leaving app_bim unregistered
+	server.Inject(iplbtest.Fault{Method: "POST", Path: "/frontend", Status: 500, Times: 1})
+	status := syncer.Sync()
+	if status.Error == "" || !status.LastSuccess.IsZero() {
+		t.Errorf("expected the sync to fail, got %+v", status)
+	}
+	expected := []string{lb.StatusFailed, lb.StatusConflict, lb.StatusConflict}
+	for i, result := range status.Services {
+		if result.Status != expected[i] || result.Error == "" {
+			t.Errorf("expected service %d to be %s with an error, got %+v", i, expected[i], result)
+		}
+	}
+
+	status = syncer.Sync()
+	if status.Error != "" || status.LastSuccess != status.Time || status.Services[0].Status != lb.StatusRegistered {
+		t.Errorf("expected the sync to succeed, got %+v", status)
+	}
+	if syncer.SinceSuccess() > time.Since(status.Time) {
+		t.Errorf("expected the time since the last sync, got %s", syncer.SinceSuccess())
+	}
+	if syncer.Status().Time != status.Time {
+		t.Errorf("expected the status of the last sync, got %+v", syncer.Status())
+	}
+}
+
+func drift(t *testing.T, action string, kind string) float64 {
+	var metric dto.Metric
+	if err := metrics.Drift.WithLabelValues(action, kind).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestSyncerDrift(t *testing.T) {
+	services := []models.Service{
+		{Frontend: "bim.example.com", Backend: "app_bim", Port: 32768, Weight: 100, FrontendPort: 80},
+	}
+	target := lb.NewMemory("10.0.0.1", "all")
+	syncer := lb.NewSyncer(target, func() []models.Service { return services })
+	before := drift(t, lb.ActionUpdate, lb.KindLink)
+
+	// Registering new services then updating them is no drift
+	for _, weight := range []int{100, 50} {
+		services[0].Weight = weight
+		if status := syncer.Sync(); status.Error != "" {
+			t.Fatal(status.Error)
+		}
+	}
+	if drift(t, lb.ActionUpdate, lb.KindLink) != before {
+		t.Errorf("expected no drift for the updated services, got %v", drift(t, lb.ActionUpdate, lb.KindLink)-before)
+	}
+
+	// The weight changed behind the agent is brought back
+	changed := []models.Service{services[0]}
+	changed[0].Weight = 10
+	if _, err := lb.Sync(target, changed); err != nil {
+		t.Fatal(err)
+	}
+	if status := syncer.Sync(); status.Error != "" || status.Changes != 1 {
+		t.Fatalf("expected the link to be updated, got %+v", status)
+	}
+	if drift(t, lb.ActionUpdate, lb.KindLink) != before+1 {
+		t.Errorf("expected a drift for the link updated out of the agent, got %v", drift(t, lb.ActionUpdate, lb.KindLink)-before)
+	}
+}
@@ -1,33 +1,102 @@
 package main
 
 import (
-	"strconv"
-	"sync"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/gin-gonic/gin"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/thbkrkr/go-utilz/http"
 	"github.com/thbkrkr/iplb-docker/api"
+	"github.com/thbkrkr/iplb-docker/emulator"
+	"github.com/thbkrkr/iplb-docker/haproxy"
 	iplbapi "github.com/thbkrkr/iplb-docker/iplb"
-	"github.com/thbkrkr/iplb-docker/models"
+	"github.com/thbkrkr/iplb-docker/iplb/record"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/metrics"
+	"github.com/thbkrkr/iplb-docker/provider"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 type Config struct {
+	// Target is the load balancer the services are registered in, iplb,
+	// haproxy or emulate, set by the emulate command. The OVH settings are
+	// required by the iplb one only.
+	Target string `envconfig:"TARGET" default:"iplb"`
+	// LocalAddress is the one of the local services for the haproxy and
+	// emulate targets.
+	LocalAddress string `envconfig:"LOCAL_ADDRESS" default:"127.0.0.1"`
+
 	OvhEndpoint          string `envconfig:"OVH_ENDPOINT" default:"ovh-eu"`
-	OvhApplicationKey    string `envconfig:"OVH_AK" required:"true"`
-	OvhApplicationSecret string `envconfig:"OVH_AS" required:"true"`
-	OvhConsumerKey       string `envconfig:"OVH_CK" required:"true"`
-	IpLbServiceName      string `envconfig:"OVH_SERVICENAME" required:"true"`
+	OvhApplicationKey    string `envconfig:"OVH_AK"`
+	OvhApplicationSecret string `envconfig:"OVH_AS"`
+	OvhConsumerKey       string `envconfig:"OVH_CK"`
+	IpLbServiceName      string `envconfig:"OVH_SERVICENAME"`
+	// OvhRecord is a fixture file recording the interactions with the OVH
+	// API, replayed offline by the tests.
+	OvhRecord string `envconfig:"OVH_RECORD"`
+
+	// The haproxy target renders HAProxyConfig and reloads HAProxy with the
+	// command when given, by sending the signal to the process of the pid
+	// file otherwise.
+	HAProxyConfig        string `envconfig:"HAPROXY_CONFIG" default:"/etc/haproxy/haproxy.cfg"`
+	HAProxyCertPath      string `envconfig:"HAPROXY_CERT_PATH"`
+	HAProxyReloadCommand string `envconfig:"HAPROXY_RELOAD_COMMAND"`
+	HAProxyPidFile       string `envconfig:"HAPROXY_PID_FILE"`
+	HAProxyReloadSignal  string `envconfig:"HAPROXY_RELOAD_SIGNAL" default:"USR2"`
+
+	// The emulate target proxies the requests itself, listening on the
+	// frontend ports of EmulateListen, with the certificate for SSL ones.
+	EmulateListen   string `envconfig:"EMULATE_LISTEN"`
+	EmulateCertFile string `envconfig:"EMULATE_CERT_FILE"`
+	EmulateKeyFile  string `envconfig:"EMULATE_KEY_FILE"`
+
+	LabelPrefix      string `envconfig:"LABEL_PREFIX" default:"iplb"`
+	DefaultDomain    string `envconfig:"DEFAULT_DOMAIN"`
+	ExposedByDefault bool   `envconfig:"EXPOSED_BY_DEFAULT" default:"true"`
+	Constraints      string `envconfig:"CONSTRAINTS"`
+	ServicesFile     string `envconfig:"SERVICES_FILE"`
+	SwarmMode        bool   `envconfig:"SWARM_MODE"`
+
+	// MaxSyncAge is the time without successful sync or with a disconnected
+	// provider after which /healthz fails for the agent to be restarted.
+	MaxSyncAge time.Duration `envconfig:"MAX_SYNC_AGE" default:"5m"`
+
+	// ServicesStore persists the services registered through the HTTP API, in
+	// the /data volume of the image to survive the restarts of the agent.
+	ServicesStore string `envconfig:"SERVICES_STORE" default:"/data/iplb-services.json"`
+
+	// Docker can be disabled to only discover services from the other sources.
+	Docker bool `envconfig:"DOCKER" default:"true"`
+	// DockerEndpoints are the daemons to watch instead of the local one, as
+	// <host address>=<endpoint>, like 10.0.0.2=tcp://10.0.0.2:2376 or
+	// 10.0.0.3=unix:///var/run/docker-10.0.0.3.sock for a forwarded socket.
+	DockerEndpoints []string `envconfig:"DOCKER_ENDPOINTS"`
+	// DockerCertPath holds the ca.pem, cert.pem and key.pem of the TLS
+	// endpoints, or a directory by host address with their own.
+	DockerCertPath string `envconfig:"DOCKER_ENDPOINTS_CERT_PATH"`
+
+	// Kubernetes watches the Services and Ingresses of a cluster, using the
+	// kubeconfig file when given, the service account of the pod otherwise.
+	Kubernetes          bool   `envconfig:"KUBERNETES"`
+	Kubeconfig          string `envconfig:"KUBECONFIG"`
+	KubernetesNamespace string `envconfig:"KUBERNETES_NAMESPACE"`
 }
 
 const (
-	backendLabel  = "iplb.backend"
-	frontendLabel = "iplb.frontend.rule"
-	portLabel     = "iplb.port"
-	syncInterval  = 30
+	syncInterval       = 30
+	fileWatchInterval  = 5
+	swarmWatchInterval = 10
+	kubeWatchInterval  = 10
 )
 
 var (
@@ -37,10 +106,8 @@ var (
 )
 
 var (
-	docker   *dockerapi.Client
 	config   Config
-	services = []models.Service{}
-	lock     sync.Mutex
+	registry = provider.NewRegistry()
 )
 
 func main() {
@@ -50,121 +117,191 @@ func main() {
 		logrus.WithError(err).Fatal("Fail to process config")
 	}
 
-	// Create Docker client
-	docker, err := dockerapi.NewClientFromEnv()
-	assert(err, "Fail to create Docker client")
-
-	// Create IPLB client
-	iplb, err := iplbapi.NewIPLB(config.OvhEndpoint,
-		config.OvhApplicationKey, config.OvhApplicationSecret, config.OvhConsumerKey,
-		config.IpLbServiceName)
-	assert(err, "Fail to create OVH IPLB client")
-
-	// Get running containers
-	containers, err := docker.ListContainers(dockerapi.ListContainersOptions{})
-	assert(err, "Fail to list Docker containers")
-
-	// Filter services to register to iplb in containers list
-	for _, container := range containers {
-		service := Service(container.Labels)
-		if service != nil {
-			services = append(services, *service)
+	// iplb-docker emulate proxies the requests locally instead of using an IPLB
+	if len(os.Args) > 1 && os.Args[1] == "emulate" {
+		config.Target = "emulate"
+	}
+
+	// Create load balancer client
+	target, err := loadBalancer()
+	assert(err, "Fail to create "+config.Target+" load balancer client")
+
+	parser, err := labels.NewParser(config.LabelPrefix, config.DefaultDomain,
+		config.ExposedByDefault, config.Constraints)
+	assert(err, "Fail to parse constraints")
+
+	// Service discovery providers
+	providers := []provider.Provider{}
+	switch {
+	case !config.Docker:
+
+	case config.SwarmMode:
+		docker, err := dockerapi.NewClientFromEnv()
+		assert(err, "Fail to create Docker client")
+		swarm, err := provider.NewSwarm(docker, parser, time.Duration(swarmWatchInterval)*time.Second)
+		assert(err, "Fail to create Swarm provider")
+		providers = append(providers, swarm)
+
+	case len(config.DockerEndpoints) > 0:
+		for _, endpoint := range config.DockerEndpoints {
+			address, docker, err := dockerClient(endpoint)
+			assert(err, "Fail to create Docker client for "+endpoint)
+			providers = append(providers, provider.NewDocker(docker, parser, address))
+		}
+
+	default:
+		docker, err := dockerapi.NewClientFromEnv()
+		assert(err, "Fail to create Docker client")
+		providers = append(providers, provider.NewDocker(docker, parser, ""))
+	}
+	if config.Kubernetes {
+		kube, err := kubernetesClient(config.Kubeconfig)
+		assert(err, "Fail to create Kubernetes client")
+		providers = append(providers, provider.NewKubernetes(kube, parser, config.KubernetesNamespace,
+			time.Duration(kubeWatchInterval)*time.Second))
+	}
+	if config.ServicesFile != "" {
+		providers = append(providers, provider.NewFile(config.ServicesFile, parser,
+			time.Duration(fileWatchInterval)*time.Second))
+	}
+
+	manual, err := provider.NewManual(config.ServicesStore, parser)
+	assert(err, "Fail to load manual services")
+	providers = append(providers, manual)
+	for i, p := range providers {
+		providers[i] = provider.Supervise(p)
+	}
+
+	// Get current services
+	for _, p := range providers {
+		services, err := p.List()
+		if err != nil {
+			logrus.WithError(err).Errorf("Fail to list services of provider %s", p.Name())
+			continue
 		}
+		registry.Set(provider.ServiceSet{Provider: p.Name(), Services: services})
 	}
 
 	// Sync services in IPLB
-	iplb.Sync(services)
+	syncer := lb.NewSyncer(target, registry.Services)
+	syncer.Sync()
 	quit := make(chan struct{})
-	go func() {
-		syncTicker := time.NewTicker(time.Duration(syncInterval) * time.Second)
-		for {
-			select {
-
-			case <-syncTicker.C:
-				lock.Lock()
-				iplb.Sync(services)
-				lock.Unlock()
-
-			case <-quit:
-				syncTicker.Stop()
-				return
-			}
-		}
-	}()
+	go syncer.Run(time.Duration(syncInterval)*time.Second, quit)
 
-	// Listen docker events
-	go func() {
-		events := make(chan *dockerapi.APIEvents)
-		assert(docker.AddEventListener(events), "Fail to listen Docker events")
-
-		for msg := range events {
-			switch msg.Status {
-
-			// Add service
-			case "start":
-				service := Service(msg.Actor.Attributes)
-				if service != nil {
-					addService(*service)
-				}
-
-			// Remove service
-			case "die":
-				service := Service(msg.Actor.Attributes)
-				if service != nil {
-					removeService(*service)
-				}
+	// Watch providers
+	sets := make(chan provider.ServiceSet)
+	for _, p := range providers {
+		go func(p provider.Provider) {
+			// Stopped by quit without error at shutdown, failing /healthz
+			// otherwise
+			if err := p.Watch(sets, quit); err != nil {
+				logrus.WithError(err).Errorf("Provider %s stopped watching", p.Name())
 			}
+		}(p)
+	}
+	go func() {
+		for set := range sets {
+			registry.Set(set)
 		}
 	}()
 
 	// HTTP API
-	API := api.Api{IPLB: iplb}
+	API := api.Api{LB: target, Syncer: syncer, Providers: providers, Registry: registry, Manual: manual,
+		MaxSyncAge: config.MaxSyncAge}
 	http.API(name, buildDate, gitCommit, func(r *gin.Engine) {
 		r.GET("/backend", API.Backends)
 		r.GET("/frontend", API.Frontends)
+		r.GET("/route", API.Routes)
 		r.GET("/server", API.Servers)
 		r.GET("/link", API.Links)
+		r.GET("/provider", API.ProviderStatuses)
+		r.GET("/project", API.Projects)
+		r.GET("/service", API.ManualServices)
+		r.POST("/service", API.AddService)
+		r.PUT("/service/:id", API.UpdateService)
+		r.DELETE("/service/:id", API.DeleteService)
+		r.GET("/services", API.Services)
+		r.GET("/sync/status", API.SyncStatus)
+		r.GET("/plan", API.Plan)
+		r.POST("/sync", API.Sync)
+		r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+		r.GET("/healthz", API.Healthz)
+		r.GET("/readyz", API.Readyz)
 	})
 
 	close(quit)
-	logrus.Fatal("Docker event loop closed")
+	logrus.Fatal("HTTP API stopped")
 }
 
-func Service(attributes map[string]string) *models.Service {
-	port := attributes[portLabel]
-	backend := attributes[backendLabel]
-	frontend := attributes[frontendLabel]
-	if port != "" && backend != "" && frontend != "" {
-		portNum, err := strconv.Atoi(port)
+func loadBalancer() (lb.LoadBalancer, error) {
+	switch config.Target {
+	case "iplb":
+		if config.OvhApplicationKey == "" || config.OvhApplicationSecret == "" ||
+			config.OvhConsumerKey == "" || config.IpLbServiceName == "" {
+			return nil, fmt.Errorf("OVH_AK, OVH_AS, OVH_CK and OVH_SERVICENAME are required by the iplb target")
+		}
+		iplb, err := iplbapi.NewIPLB(config.OvhEndpoint,
+			config.OvhApplicationKey, config.OvhApplicationSecret, config.OvhConsumerKey,
+			config.IpLbServiceName)
 		if err != nil {
-			logrus.WithError(err).Errorf("Fail to parse port %s for frontend %s", port, frontend)
-			return nil
+			return nil, err
 		}
-		return &models.Service{Frontend: frontend, Backend: backend, Port: portNum}
-	}
-	return nil
-}
+		if config.OvhRecord != "" {
+			logrus.WithField("path", config.OvhRecord).Warn("Record OVH API interactions")
+			iplb.Client.Client.Transport = record.NewRecorder(config.OvhRecord, iplb.Client.Client.Transport)
+		}
+		iplb.Client.Client.Transport = &metrics.Transport{Next: iplb.Client.Client.Transport}
+		return iplb, nil
 
-func addService(service models.Service) {
-	lock.Lock()
-	defer lock.Unlock()
+	case "haproxy":
+		return haproxy.NewHAProxy(config.HAProxyConfig, config.LocalAddress, config.HAProxyCertPath,
+			config.HAProxyReloadCommand, config.HAProxyPidFile, config.HAProxyReloadSignal)
 
-	services = append(services, service)
+	case "emulate":
+		return emulator.NewEmulator(config.LocalAddress, config.EmulateListen,
+			config.EmulateCertFile, config.EmulateKeyFile), nil
+	}
+
+	return nil, fmt.Errorf("unknown target %s, expected iplb, haproxy or emulate", config.Target)
 }
 
-func removeService(service models.Service) {
-	lock.Lock()
-	defer lock.Unlock()
+// dockerClient creates the client of a daemon given as
+// <host address>=<endpoint>, using TLS for tcp endpoints when a cert path is
+// configured.
+func dockerClient(endpoint string) (string, *dockerapi.Client, error) {
+	parts := strings.SplitN(endpoint, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, fmt.Errorf("invalid Docker endpoint %s, expected <host address>=<endpoint>", endpoint)
+	}
+	address, url := parts[0], parts[1]
 
-	for i := 0; i < len(services); i++ {
-		if service.Backend == services[i].Backend &&
-			service.Frontend == services[i].Frontend &&
-			service.Port == services[i].Port {
-			services = append(services[:i], services[i+1:]...)
-			break
-		}
+	if config.DockerCertPath == "" || !strings.HasPrefix(url, "tcp://") {
+		docker, err := dockerapi.NewClient(url)
+		return address, docker, err
+	}
 
+	certPath := config.DockerCertPath
+	if info, err := os.Stat(filepath.Join(certPath, address)); err == nil && info.IsDir() {
+		certPath = filepath.Join(certPath, address)
 	}
+	docker, err := dockerapi.NewTLSClient(url,
+		filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"), filepath.Join(certPath, "ca.pem"))
+	return address, docker, err
+}
+
+func kubernetesClient(kubeconfig string) (*kubernetes.Clientset, error) {
+	var restConfig *rest.Config
+	var err error
+	if kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
 }
 
 func assert(err error, message string) {
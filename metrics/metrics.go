@@ -0,0 +1,117 @@
+// Package metrics exposes the Prometheus metrics of the agent.
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "iplb"
+
+var (
+	SyncRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_runs_total",
+		Help:      "Syncs of the services in the load balancer by result, success or failure.",
+	}, []string{"result"})
+
+	SyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of the syncs of the services in the load balancer.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	Drift = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drift_changes_total",
+		Help:      "Changes bringing the load balancer back to the last synced services, made out of the agent, by action and kind.",
+	}, []string{"action", "kind"})
+
+	Services = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registered_services",
+		Help:      "Services to register by provider.",
+	}, []string{"provider"})
+
+	OwnedLinks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "owned_links",
+		Help:      "Links of the load balancer registered by the last sync.",
+	})
+
+	OvhRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ovh_requests_total",
+		Help:      "Requests to the OVH API by method, path template and status, 0 for transport errors.",
+	}, []string{"method", "path", "status"})
+
+	OvhRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ovh_request_duration_seconds",
+		Help:      "Duration of the requests to the OVH API by method and path template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "path"})
+
+	DockerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "docker_events_total",
+		Help:      "Docker events received by provider and action.",
+	}, []string{"provider", "action"})
+
+	ProviderRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_retries_total",
+		Help:      "Retries of the connection of the providers to their source, like a lost Docker event stream.",
+	}, []string{"provider"})
+)
+
+func init() {
+	prometheus.MustRegister(SyncRuns, SyncDuration, Drift, Services, OwnedLinks,
+		OvhRequests, OvhRequestDuration, DockerEvents, ProviderRetries)
+}
+
+// Transport counts the requests to the OVH API, with their paths templated to
+// keep the cardinality of the metrics low.
+type Transport struct {
+	Next http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	path := PathTemplate(req.URL.Path)
+	start := time.Now()
+	resp, err := next.RoundTrip(req)
+	OvhRequestDuration.WithLabelValues(req.Method, path).Observe(time.Since(start).Seconds())
+
+	status := "0"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	OvhRequests.WithLabelValues(req.Method, path, status).Inc()
+
+	return resp, err
+}
+
+var (
+	serviceNameSegment = regexp.MustCompile(`/ipLoadbalancing/[^/]+`)
+	idSegment          = regexp.MustCompile(`/[0-9]+(/|$)`)
+)
+
+// PathTemplate replaces the service name and the IDs of a path of the OVH API,
+// like /1.0/ipLoadbalancing/{serviceName}/backend/{id}/server.
+func PathTemplate(path string) string {
+	path = serviceNameSegment.ReplaceAllString(path, "/ipLoadbalancing/{serviceName}")
+	for idSegment.MatchString(path) {
+		path = idSegment.ReplaceAllString(path, "/{id}$1")
+	}
+	return path
+}
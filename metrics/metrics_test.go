@@ -0,0 +1,16 @@
+package metrics
+
+import "testing"
+
+func TestPathTemplate(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/1.0/auth/time": "/1.0/auth/time",
+		"/1.0/ipLoadbalancing/loadbalancer-1a2b/backend":     "/1.0/ipLoadbalancing/{serviceName}/backend",
+		"/1.0/ipLoadbalancing/loadbalancer-1a2b/frontend/42": "/1.0/ipLoadbalancing/{serviceName}/frontend/{id}",
+		"/1.0/ipLoadbalancing/lb/backend/4/server/12":        "/1.0/ipLoadbalancing/{serviceName}/backend/{id}/server/{id}",
+	} {
+		if actual := PathTemplate(path); actual != expected {
+			t.Errorf("PathTemplate(%q) = %q, expected %q", path, actual, expected)
+		}
+	}
+}
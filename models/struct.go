@@ -1,9 +1,47 @@
 package models
 
+import "time"
+
+// Service is a port to register in the IPLB. Its Address is the one of the
+// server hosting it, the host of the agent when empty. Origin is the provider
+// which discovered it in Container, part of Project for compose services.
+// Type is http, routed by the host of its Frontend rule, or tcp, its backend
+// being the default one of its frontend port.
 type Service struct {
-	Frontend string
-	Backend  string
-	Port     int
+	Name      string
+	Origin    string
+	Container string
+	Project   string
+	Address   string
+	Frontend  string
+	Backend   string
+	Port      int
+	Type      string
+	Probe     *Probe
+	Weight    int
+	Backup    bool
+
+	ProxyProtocol string
+	SSL           bool
+	Chain         string
+	Cookie        string
+
+	FrontendPort  int
+	FrontendSSL   bool
+	AllowedSource []string
+	HTTPHeader    []string
+}
+
+// Probe is the health check run by the IPLB against the links of a backend.
+// A nil probe means the links of the service are not probed.
+type Probe struct {
+	Type     string `json:"type"`
+	URL      string `json:"url,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Match    string `json:"match,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	Interval int    `json:"interval,omitempty"`
+	Negate   bool   `json:"negate"`
 }
 
 type IPLBService struct {
@@ -12,12 +50,19 @@ type IPLBService struct {
 }
 
 type AddBackend struct {
+	Name string `json:"name,omitempty"`
 	Zone string `json:"zone"`
 	Port int    `json:"port"`
 	//Stickiness string `json:"stickiness"`
 	//Balance string `json:"balance"`
 	Type  string `json:"type"`
-	Probe string `json:"probe"`
+	Probe *Probe `json:"probe,omitempty"`
+}
+
+// UpdateBackend sets the probe of a backend, removed when nil.
+type UpdateBackend struct {
+	Name  string `json:"name,omitempty"`
+	Probe *Probe `json:"probe"`
 }
 
 type Backend struct {
@@ -28,29 +73,39 @@ type Backend struct {
 	Stickiness string `json:"stickiness"`
 	Balance    string `json:"balance"`
 	Type       string `json:"type"`
-	Probe      string `json:"probe"`
+	Probe      *Probe `json:"probe"`
 }
 
+// AddFrontend adds the frontend of a port, the requests being sent to the
+// backends of its routes, or to its default backend when set.
 type AddFrontend struct {
-	//AllowedSource string `json:"allowedSource"`
-	DefaultBackendID int `json:"defaultBackendId"`
+	AllowedSource    []string `json:"allowedSource,omitempty"`
+	DefaultBackendID int      `json:"defaultBackendId,omitempty"`
 	//DefaulSSlID string `json:"defaulSslId"`
-	HSTS bool `json:"hsts"`
-	//HTTPHeader string `json:"httpHeader"`
-	Port int `json:"port"`
+	HSTS       bool     `json:"hsts"`
+	HTTPHeader []string `json:"httpHeader,omitempty"`
+	Port       int      `json:"port"`
 	//RedirectLocation string `json:"redirectLocation"`
 	SSL  bool   `json:"ssl"`
 	Zone string `json:"zone"`
 }
 
+type UpdateFrontend struct {
+	AllowedSource    []string `json:"allowedSource"`
+	DefaultBackendID int      `json:"defaultBackendId,omitempty"`
+	HTTPHeader       []string `json:"httpHeader"`
+	Port             string   `json:"port"`
+	SSL              bool     `json:"ssl"`
+}
+
 type Frontend struct {
-	ID int `json:"id"`
-	//AllowedSource string `json:"allowedSource"`
-	DefaultBackendID int `json:"defaultBackendId"`
+	ID               int      `json:"id"`
+	AllowedSource    []string `json:"allowedSource"`
+	DefaultBackendID int      `json:"defaultBackendId"`
 	//DefaulSSlID string `json:"defaulSslId"`
-	HSTS bool `json:"hsts"`
-	//HTTPHeader string `json:"httpHeader"`
-	Port string `json:"port"` // Why not an int here?
+	HSTS       bool     `json:"hsts"`
+	HTTPHeader []string `json:"httpHeader"`
+	Port       string   `json:"port"` // Why not an int here?
 	//RedirectLocation string `json:"redirectLocation"`
 	SSL  bool   `json:"ssl"`
 	Zone string `json:"zone"`
@@ -70,26 +125,140 @@ type Server struct {
 }
 
 type AddLink struct {
-	Backup bool `json:"backup"`
-	//Chain string `json:"chain"`
-	//Cookie string `json:"cookie"`
-	Port  int  `json:"port"`
-	Probe bool `json:"probe"`
-	//ProxyProtocolVersion string `json:"proxyProtocolVersion"`
-	ServerID int  `json:"serverId"`
-	SSL      bool `json:"ssl"`
-	Weight   int  `json:"weight"`
+	Backup               bool   `json:"backup"`
+	Chain                string `json:"chain,omitempty"`
+	Cookie               string `json:"cookie,omitempty"`
+	Port                 int    `json:"port"`
+	Probe                bool   `json:"probe"`
+	ProxyProtocolVersion string `json:"proxyProtocolVersion,omitempty"`
+	ServerID             int    `json:"serverId"`
+	SSL                  bool   `json:"ssl"`
+	Weight               int    `json:"weight"`
+}
+
+// UpdateLink sets all the options of a link, the empty ones being removed.
+type UpdateLink struct {
+	Backup               bool   `json:"backup"`
+	Chain                string `json:"chain"`
+	Cookie               string `json:"cookie"`
+	Probe                bool   `json:"probe"`
+	ProxyProtocolVersion string `json:"proxyProtocolVersion"`
+	SSL                  bool   `json:"ssl"`
+	Weight               int    `json:"weight"`
 }
 
 type Link struct {
-	ID     int  `json:"id"`
-	Backup bool `json:"backup"`
-	//Chain string `json:"chain"`
-	//Cookie string `json:"cookie"`
-	Port  int  `json:"port"`
-	Probe bool `json:"probe"`
-	//ProxyProtocolVersion string `json:"proxyProtocolVersion"`
-	ServerID int  `json:"serverId"`
-	SSL      bool `json:"ssl"`
-	Weight   int  `json:"weight"`
+	ID                   int    `json:"id"`
+	Backup               bool   `json:"backup"`
+	Chain                string `json:"chain"`
+	Cookie               string `json:"cookie"`
+	Port                 int    `json:"port"`
+	Probe                bool   `json:"probe"`
+	ProxyProtocolVersion string `json:"proxyProtocolVersion"`
+	ServerID             int    `json:"serverId"`
+	SSL                  bool   `json:"ssl"`
+	Weight               int    `json:"weight"`
+}
+
+// AddRoute sends the requests of a frontend matching the rules of the route
+// to a backend.
+type AddRoute struct {
+	BackendID  int `json:"backendId"`
+	FrontendID int `json:"frontendId"`
+}
+
+type UpdateRoute struct {
+	BackendID int `json:"backendId"`
+}
+
+// AddRouteRule matches the requests of a route, like the host field being
+// a host name.
+type AddRouteRule struct {
+	Field   string `json:"field"`
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+}
+
+type RouteRule struct {
+	ID      int    `json:"id"`
+	Field   string `json:"field"`
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+}
+
+type Route struct {
+	ID         int         `json:"id"`
+	BackendID  int         `json:"backendId"`
+	FrontendID int         `json:"frontendId"`
+	Rules      []RouteRule `json:"rules"`
+}
+
+// State is the configuration of a load balancer. Address is the one of the
+// servers of the services without address, in Zone.
+type State struct {
+	Address   string         `json:"address"`
+	Zone      string         `json:"zone"`
+	Servers   []Server       `json:"servers"`
+	Backends  []Backend      `json:"backends"`
+	Frontends []Frontend     `json:"frontends"`
+	Routes    []Route        `json:"routes"`
+	Links     map[int][]Link `json:"links"`
+}
+
+// Plan is the list of changes registering services in a load balancer
+// configuration. The frontends and routes the services disagree on are
+// skipped, their conflicts being kept by frontend or route key.
+type Plan struct {
+	State     *State            `json:"-"`
+	Services  []Service         `json:"-"`
+	Changes   []Change          `json:"changes"`
+	Conflicts map[string]string `json:"conflicts,omitempty"`
+}
+
+// Change adds or updates a server, backend, frontend, route or link for a
+// service. ID is the one of the updated object, and BackendID the one of the
+// backend of an updated link.
+type Change struct {
+	Action    string  `json:"action"`
+	Kind      string  `json:"kind"`
+	ID        int     `json:"id,omitempty"`
+	BackendID int     `json:"backendId,omitempty"`
+	Service   Service `json:"service"`
+}
+
+type Refresh struct {
+	Zone string `json:"zone,omitempty"`
+}
+
+type Task struct {
+	ID           int    `json:"id"`
+	Action       string `json:"action"`
+	Status       string `json:"status"`
+	CreationDate string `json:"creationDate"`
+}
+
+// SyncStatus is the result of a sync of the services in a load balancer.
+type SyncStatus struct {
+	Time        time.Time       `json:"time"`
+	Duration    string          `json:"duration"`
+	Changes     int             `json:"changes"`
+	Error       string          `json:"error,omitempty"`
+	LastSuccess time.Time       `json:"lastSuccess"`
+	Services    []ServiceResult `json:"services"`
+}
+
+// ServiceResult is the result of the sync of a service: registered, in
+// conflict with the services sharing its frontend or failed.
+type ServiceResult struct {
+	Service Service `json:"service"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Check is the state of a dependency of the agent, reported by the health
+// endpoints.
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
 }
@@ -0,0 +1,194 @@
+package provider
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/metrics"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const defaultReconnectDelay = 10 * time.Second
+
+// Docker reads the services from the labels of the running containers and
+// follows their start, die and health events, the unhealthy containers being
+// left out. The services are registered on the Address of the daemon host,
+// the host of the agent when empty.
+type Docker struct {
+	Client         *dockerapi.Client
+	Parser         *labels.Parser
+	Address        string
+	ReconnectDelay time.Duration
+
+	connectivity
+	containers map[string][]models.Service
+	lock       sync.Mutex
+}
+
+func NewDocker(client *dockerapi.Client, parser *labels.Parser, address string) *Docker {
+	return &Docker{
+		Client:         client,
+		Parser:         parser,
+		Address:        address,
+		ReconnectDelay: defaultReconnectDelay,
+		containers:     map[string][]models.Service{},
+	}
+}
+
+func (d *Docker) Name() string {
+	if d.Address == "" {
+		return "docker"
+	}
+	return "docker:" + d.Address
+}
+
+func (d *Docker) List() ([]models.Service, error) {
+	containers, err := d.Client.ListContainers(dockerapi.ListContainersOptions{})
+	d.setStatus(d.Name(), err)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	d.containers = map[string][]models.Service{}
+	d.lock.Unlock()
+
+	for _, container := range containers {
+		if strings.Contains(container.Status, "(unhealthy)") {
+			continue
+		}
+		d.add(container.ID)
+	}
+
+	return d.services(), nil
+}
+
+// Watch follows the events of the daemon and reconnects when the stream is
+// lost, listing the containers again since events may have been missed.
+func (d *Docker) Watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	for {
+		err := d.watch(sets, stop)
+		if err == nil {
+			return nil
+		}
+
+		d.setStatus(d.Name(), err)
+		logrus.WithError(err).WithField("provider", d.Name()).Error("Lost Docker event stream")
+		metrics.ProviderRetries.WithLabelValues(d.Name()).Inc()
+
+		select {
+		case <-time.After(d.ReconnectDelay):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (d *Docker) watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	events := make(chan *dockerapi.APIEvents)
+	if err := d.Client.AddEventListener(events); err != nil {
+		return err
+	}
+	defer d.Client.RemoveEventListener(events)
+
+	services, err := d.List()
+	if err != nil {
+		return err
+	}
+	sets <- ServiceSet{Provider: d.Name(), Services: services}
+
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return errors.New("Docker event stream closed")
+			}
+
+			// Keep health_status and exec_start without their details
+			action := strings.SplitN(msg.Action, ":", 2)[0]
+			metrics.DockerEvents.WithLabelValues(d.Name(), action).Inc()
+
+			switch msg.Status {
+
+			// Add service
+			case "start", "health_status: healthy":
+				d.add(msg.Actor.ID)
+
+			// Remove service
+			case "die", "health_status: unhealthy":
+				d.remove(msg.Actor.ID)
+
+			default:
+				continue
+			}
+
+			sets <- ServiceSet{Provider: d.Name(), Services: d.services()}
+
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (d *Docker) add(ID string) {
+	container, err := d.inspect(ID)
+	if err != nil {
+		logrus.WithError(err).WithField("container", ID).Error("Fail to inspect container")
+		return
+	}
+
+	services := d.Parser.Services(container)
+	for i := range services {
+		services[i].Address = d.Address
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(services) > 0 {
+		d.containers[ID] = services
+	}
+}
+
+func (d *Docker) remove(ID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.containers, ID)
+}
+
+// inspect returns the metadata of a container the labels can refer to.
+func (d *Docker) inspect(ID string) (labels.Container, error) {
+	container, err := d.Client.InspectContainer(ID)
+	if err != nil {
+		return labels.Container{}, err
+	}
+
+	return labels.NewContainer(container.ID, container.Name, container.Config.Image,
+		container.Config.Env, container.Config.Labels), nil
+}
+
+// services returns the services of all the containers, sorted by container.
+func (d *Docker) services() []models.Service {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	IDs := make([]string, 0, len(d.containers))
+	for ID := range d.containers {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	services := []models.Service{}
+	for _, ID := range IDs {
+		services = append(services, d.containers[ID]...)
+	}
+
+	return services
+}
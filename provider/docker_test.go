@@ -0,0 +1,185 @@
+package provider_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thbkrkr/iplb-docker/iplb"
+	"github.com/thbkrkr/iplb-docker/iplb/iplbtest"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/lb"
+	"github.com/thbkrkr/iplb-docker/models"
+	"github.com/thbkrkr/iplb-docker/provider"
+	"github.com/thbkrkr/iplb-docker/provider/dockertest"
+)
+
+const timeout = 5 * time.Second
+
+func app(ID string, port string) dockertest.Container {
+	return dockertest.Container{
+		ID:    ID,
+		Name:  "app-" + ID,
+		Image: "krkr/apish",
+		Labels: map[string]string{
+			"iplb.port":          port,
+			"iplb.backend":       "app",
+			"iplb.frontend.rule": "app.example.com",
+		},
+	}
+}
+
+func newDocker(t *testing.T, daemon *dockertest.Daemon) *provider.Docker {
+	client, err := daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := labels.NewParser("iplb", "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker := provider.NewDocker(client, parser, "10.0.0.1")
+	docker.ReconnectDelay = 200 * time.Millisecond
+	return docker
+}
+
+// watch runs the provider until the test ends.
+func watch(t *testing.T, docker *provider.Docker) <-chan provider.ServiceSet {
+	sets := make(chan provider.ServiceSet)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+
+	go docker.Watch(sets, stop)
+	return sets
+}
+
+// waitFor returns the first set of services with the given ports.
+func waitFor(t *testing.T, sets <-chan provider.ServiceSet, ports ...int) []models.Service {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case set := <-sets:
+			if hasPorts(set.Services, ports) {
+				return set.Services
+			}
+		case <-deadline:
+			t.Fatalf("no set of services with ports %v", ports)
+		}
+	}
+}
+
+func hasPorts(services []models.Service, ports []int) bool {
+	if len(services) != len(ports) {
+		return false
+	}
+	for i, service := range services {
+		if service.Port != ports[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDockerWatch(t *testing.T) {
+	daemon := dockertest.NewDaemon()
+	defer daemon.Close()
+	daemon.Start(app("a", "8080"))
+
+	docker := newDocker(t, daemon)
+	sets := watch(t, docker)
+
+	services := waitFor(t, sets, 8080)
+	if services[0].Address != "10.0.0.1" || services[0].Backend != "app" || services[0].Container != "app-a" {
+		t.Errorf("unexpected service %+v", services[0])
+	}
+
+	daemon.Start(app("b", "8081"))
+	waitFor(t, sets, 8080, 8081)
+
+	daemon.Health("b", "unhealthy")
+	waitFor(t, sets, 8080)
+
+	daemon.Health("b", "healthy")
+	waitFor(t, sets, 8080, 8081)
+
+	daemon.Die("a")
+	waitFor(t, sets, 8081)
+}
+
+func TestDockerListSkipsUnhealthy(t *testing.T) {
+	daemon := dockertest.NewDaemon()
+	defer daemon.Close()
+	daemon.Start(app("a", "8080"))
+	daemon.Start(app("b", "8081"))
+	daemon.Health("b", "unhealthy")
+
+	services, err := newDocker(t, daemon).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPorts(services, []int{8080}) {
+		t.Errorf("expected the unhealthy container to be skipped, got %+v", services)
+	}
+}
+
+func TestDockerReconnect(t *testing.T) {
+	daemon := dockertest.NewDaemon()
+	defer daemon.Close()
+	daemon.Start(app("a", "8080"))
+
+	docker := newDocker(t, daemon)
+	sets := watch(t, docker)
+	waitFor(t, sets, 8080)
+
+	// The container started while disconnected is found by listing again
+	daemon.Disconnect()
+	daemon.Start(app("b", "8081"))
+
+	deadline := time.After(timeout)
+	for docker.Status().Connected {
+		select {
+		case <-deadline:
+			t.Fatal("expected the provider to be disconnected")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	waitFor(t, sets, 8080, 8081)
+	if status := docker.Status(); !status.Connected || status.Error != "" {
+		t.Errorf("expected the provider to be connected again, got %+v", status)
+	}
+}
+
+func TestDockerSync(t *testing.T) {
+	daemon := dockertest.NewDaemon()
+	defer daemon.Close()
+	server := iplbtest.NewServer("loadbalancer-test")
+	defer server.Close()
+
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &iplb.IPLB{ServiceName: server.ServiceName, Address: "10.0.0.1", Client: client}
+	registry := provider.NewRegistry()
+
+	docker := newDocker(t, daemon)
+	sets := watch(t, docker)
+	daemon.Start(app("a", "8080"))
+	daemon.Start(app("b", "8081"))
+
+	registry.Set(provider.ServiceSet{Provider: docker.Name(), Services: waitFor(t, sets, 8080, 8081)})
+	if _, err := lb.Sync(target, registry.Services()); err != nil {
+		t.Fatal(err)
+	}
+
+	state := server.State()
+	if len(state.Backends) != 1 || state.Backends[0].Name != "app" {
+		t.Fatalf("expected the app backend, got %+v", state.Backends)
+	}
+	links := state.Links[state.Backends[0].ID]
+	if len(links) != 2 || links[0].Port != 8080 || links[1].Port != 8081 {
+		t.Errorf("expected a link by container, got %+v", links)
+	}
+}
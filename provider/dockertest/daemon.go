@@ -0,0 +1,239 @@
+// Package dockertest provides a fake Docker daemon for tests, serving the
+// subset of the Engine API used by the Docker provider.
+package dockertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Container is a container run by the daemon.
+type Container struct {
+	ID     string
+	Name   string
+	Image  string
+	Env    []string
+	Labels map[string]string
+}
+
+type container struct {
+	Container
+	health string
+}
+
+// Daemon is a fake of the /containers/json, /containers/{id}/json and
+// /events endpoints. Its containers are started, killed and made healthy or
+// not by the tests, each change being sent to the event streams.
+type Daemon struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	containers map[string]*container
+	streams    map[chan *dockerapi.APIEvents]bool
+	connected  chan struct{}
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+func NewDaemon() *Daemon {
+	d := &Daemon{
+		containers: map[string]*container{},
+		streams:    map[chan *dockerapi.APIEvents]bool{},
+		connected:  make(chan struct{}, 10),
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+	return d
+}
+
+// Client returns a Docker client of the daemon.
+func (d *Daemon) Client() (*dockerapi.Client, error) {
+	return dockerapi.NewClient(d.URL)
+}
+
+// Start runs a container and sends its start event.
+func (d *Daemon) Start(c Container) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.containers[c.ID] = &container{Container: c}
+	d.send(c.ID, "start")
+}
+
+// Die stops a container and sends its die event.
+func (d *Daemon) Die(ID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.containers, ID)
+	d.send(ID, "die")
+}
+
+// Health sets the health status of a container, healthy or unhealthy, and
+// sends its health_status event.
+func (d *Daemon) Health(ID string, status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if c, ok := d.containers[ID]; ok {
+		c.health = status
+	}
+	d.send(ID, "health_status: "+status)
+}
+
+// Disconnect closes the event streams, like a restarting daemon.
+func (d *Daemon) Disconnect() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for stream := range d.streams {
+		close(stream)
+		delete(d.streams, stream)
+	}
+}
+
+// Close ends the event streams, which never end by themselves, then shuts
+// down the daemon.
+func (d *Daemon) Close() {
+	d.Disconnect()
+	d.Server.Close()
+}
+
+// Connected returns a channel receiving a value each time a client opens an
+// event stream.
+func (d *Daemon) Connected() <-chan struct{} {
+	return d.connected
+}
+
+func (d *Daemon) send(ID string, action string) {
+	now := time.Now()
+	event := &dockerapi.APIEvents{
+		Action:   action,
+		Type:     "container",
+		Actor:    dockerapi.APIActor{ID: ID, Attributes: map[string]string{}},
+		Status:   action,
+		ID:       ID,
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+	for stream := range d.streams {
+		stream <- event
+	}
+}
+
+func (d *Daemon) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "")
+
+	switch {
+	case path == "/containers/json":
+		d.list(w)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		d.inspect(w, strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json"))
+	case path == "/events":
+		d.events(w, r)
+	default:
+		http.Error(w, `{"message":"page not found"}`, http.StatusNotFound)
+	}
+}
+
+func (d *Daemon) list(w http.ResponseWriter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	IDs := []string{}
+	for ID := range d.containers {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	containers := []dockerapi.APIContainers{}
+	for _, ID := range IDs {
+		c := d.containers[ID]
+		status := "Up 1 second"
+		if c.health != "" {
+			status += " (" + c.health + ")"
+		}
+		containers = append(containers, dockerapi.APIContainers{
+			ID:     c.ID,
+			Image:  c.Image,
+			State:  "running",
+			Status: status,
+			Names:  []string{"/" + c.Name},
+			Labels: c.Labels,
+		})
+	}
+
+	reply(w, containers)
+}
+
+func (d *Daemon) inspect(w http.ResponseWriter, ID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.containers[ID]
+	if !ok {
+		http.Error(w, `{"message":"No such container: `+ID+`"}`, http.StatusNotFound)
+		return
+	}
+
+	reply(w, dockerapi.Container{
+		ID:   c.ID,
+		Name: "/" + c.Name,
+		Config: &dockerapi.Config{
+			Image:  c.Image,
+			Env:    c.Env,
+			Labels: c.Labels,
+		},
+		State: dockerapi.State{Running: true, Status: "running"},
+	})
+}
+
+// events streams the events until the client leaves or the daemon
+// disconnects.
+func (d *Daemon) events(w http.ResponseWriter, r *http.Request) {
+	stream := make(chan *dockerapi.APIEvents, 100)
+	d.mu.Lock()
+	d.streams[stream] = true
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	select {
+	case d.connected <- struct{}{}:
+	default:
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			encoder.Encode(event)
+			w.(http.Flusher).Flush()
+
+		case <-r.Context().Done():
+			d.mu.Lock()
+			if d.streams[stream] {
+				delete(d.streams, stream)
+			}
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+func reply(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/models"
+	"gopkg.in/yaml.v2"
+)
+
+// File reads static services from a YAML file, for the processes that are not
+// containers. The labels of an entry are the ones a container would have:
+//
+//	services:
+//	  - name: grafana
+//	    address: 10.0.0.12
+//	    labels:
+//	      iplb.version: "1"
+//	      iplb.port: "3000"
+//	      iplb.backend: grafana
+//	      iplb.frontend.rule: grafana.example.com
+//
+// The address is optional and defaults to the host of the agent.
+type File struct {
+	Path     string
+	Parser   *labels.Parser
+	Interval time.Duration
+
+	connectivity
+}
+
+type fileConfig struct {
+	Services []fileService `yaml:"services"`
+}
+
+type fileService struct {
+	Name    string            `yaml:"name"`
+	Address string            `yaml:"address"`
+	Env     map[string]string `yaml:"env"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+func NewFile(path string, parser *labels.Parser, interval time.Duration) *File {
+	return &File{Path: path, Parser: parser, Interval: interval}
+}
+
+func (f *File) Name() string {
+	return "file:" + f.Path
+}
+
+// List reads the file and returns its services.
+func (f *File) List() ([]models.Service, error) {
+	services, err := f.read()
+	f.setStatus(f.Name(), err)
+	return services, err
+}
+
+func (f *File) read() ([]models.Service, error) {
+	content, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config fileConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+
+	services := []models.Service{}
+	names := map[string]bool{}
+	for _, entry := range config.Services {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("service without name in %s", f.Path)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("duplicated service %s in %s", entry.Name, f.Path)
+		}
+		names[entry.Name] = true
+
+		if entry.Address != "" && net.ParseIP(entry.Address) == nil {
+			return nil, fmt.Errorf("invalid address %s for service %s", entry.Address, entry.Name)
+		}
+
+		container := labels.Container{
+			ID:     "file:" + entry.Name,
+			Name:   entry.Name,
+			Env:    entry.Env,
+			Labels: entry.Labels,
+		}
+		if container.Env == nil {
+			container.Env = map[string]string{}
+		}
+
+		for _, service := range f.Parser.Services(container) {
+			service.Address = entry.Address
+			services = append(services, service)
+		}
+	}
+
+	return services, nil
+}
+
+// Watch polls the file and sends its services each time it is modified. A
+// file that fails to be read keeps the last services, and is read again at
+// each poll until it succeeds.
+func (f *File) Watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	var modTime time.Time
+	if info, err := os.Stat(f.Path); err == nil {
+		modTime = info.ModTime()
+	}
+	failed := !f.Status().Connected
+
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			logrus.WithError(err).WithField("file", f.Path).Error("Fail to stat services file")
+			f.setStatus(f.Name(), err)
+			failed = true
+			continue
+		}
+		if !failed && info.ModTime().Equal(modTime) {
+			continue
+		}
+
+		modTime = info.ModTime()
+		services, err := f.List()
+		failed = err != nil
+		if err != nil {
+			logrus.WithError(err).WithField("file", f.Path).Error("Fail to read services file")
+			continue
+		}
+
+		logrus.WithField("file", f.Path).Infof("Load %d services from file", len(services))
+		select {
+		case sets <- ServiceSet{Provider: f.Name(), Services: services}:
+		case <-stop:
+			return nil
+		}
+	}
+}
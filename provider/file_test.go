@@ -0,0 +1,102 @@
+package provider_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/provider"
+)
+
+const grafanaFile = `services:
+  - name: grafana
+    address: 10.0.0.12
+    labels:
+      iplb.port: "3000"
+      iplb.backend: grafana
+      iplb.frontend.rule: grafana.example.com
+`
+
+func newFile(t *testing.T, path string) *provider.File {
+	parser, err := labels.NewParser("iplb", "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.NewFile(path, parser, 20*time.Millisecond)
+}
+
+// writeFile writes the services file with the given modification time.
+func writeFile(t *testing.T, path string, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yml")
+	modTime := time.Now().Add(-time.Hour)
+	writeFile(t, path, "services: [", modTime)
+
+	file := newFile(t, path)
+	if _, err := file.List(); err == nil {
+		t.Fatal("expected an invalid file to fail")
+	}
+	if status := file.Status(); status.Connected || status.Error == "" {
+		t.Errorf("expected the error of the file in the status, got %+v", status)
+	}
+
+	sets := make(chan provider.ServiceSet)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- file.Watch(sets, stop) }()
+
+	next := func() provider.ServiceSet {
+		t.Helper()
+		select {
+		case set := <-sets:
+			return set
+		case <-time.After(timeout):
+			t.Fatal("timeout waiting for the services")
+		}
+		return provider.ServiceSet{}
+	}
+
+	// The fix is loaded even with the modification time of the invalid file
+	writeFile(t, path, grafanaFile, modTime)
+	set := next()
+	if len(set.Services) != 1 || set.Services[0].Address != "10.0.0.12" || set.Services[0].Port != 3000 {
+		t.Errorf("expected the grafana service, got %+v", set)
+	}
+	if status := file.Status(); !status.Connected {
+		t.Errorf("expected the provider to be connected, got %+v", status)
+	}
+
+	// A removed file keeps the last services until it is back
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case set := <-sets:
+		t.Errorf("expected the services to be kept, got %+v", set)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if status := file.Status(); status.Connected {
+		t.Errorf("expected the removed file to be reported, got %+v", status)
+	}
+
+	writeFile(t, path, "services: []\n", time.Now())
+	if set := next(); len(set.Services) != 0 {
+		t.Errorf("expected the services of the new file, got %+v", set)
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("expected the provider to stop without error, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/models"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Kubernetes reads the services from the annotations of the Kubernetes
+// Services and Ingresses, named like the labels of the containers, and
+// registers them on every ready node of the cluster.
+//
+// For a Service of type NodePort or LoadBalancer, the port annotation is a
+// port of the Service and the links use its node port. For an Ingress, the
+// port annotation is the node port of the ingress controller and the frontend
+// rule defaults to the host of each of its rules.
+//
+// The address of a node can be overridden by the address annotation of the
+// prefix on the node, like iplb.address.
+type Kubernetes struct {
+	Client    kubernetes.Interface
+	Parser    *labels.Parser
+	Namespace string
+	Interval  time.Duration
+
+	connectivity
+}
+
+func NewKubernetes(client kubernetes.Interface, parser *labels.Parser, namespace string, interval time.Duration) *Kubernetes {
+	return &Kubernetes{Client: client, Parser: parser, Namespace: namespace, Interval: interval}
+}
+
+func (k *Kubernetes) Name() string {
+	return "kubernetes"
+}
+
+func (k *Kubernetes) List() ([]models.Service, error) {
+	services, err := k.list(context.Background())
+	k.setStatus(k.Name(), err)
+	return services, err
+}
+
+func (k *Kubernetes) list(ctx context.Context) ([]models.Service, error) {
+	nodes, err := k.Client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	addresses := k.nodeAddresses(nodes.Items)
+
+	kubeServices, err := k.Client.CoreV1().Services(k.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	ingresses, err := k.Client.NetworkingV1().Ingresses(k.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	services := []models.Service{}
+	for _, kubeService := range kubeServices.Items {
+		services = append(services, k.serviceServices(kubeService, addresses)...)
+	}
+	for _, ingress := range ingresses.Items {
+		services = append(services, k.ingressServices(ingress, addresses)...)
+	}
+
+	return services, nil
+}
+
+// serviceServices returns the services of a NodePort or LoadBalancer Service
+// on every node.
+func (k *Kubernetes) serviceServices(kubeService corev1.Service, addresses []string) []models.Service {
+	if kubeService.Spec.Type != corev1.ServiceTypeNodePort && kubeService.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	nodePorts := map[int]int{}
+	for _, port := range kubeService.Spec.Ports {
+		if port.Protocol == corev1.ProtocolTCP && port.NodePort != 0 {
+			nodePorts[int(port.Port)] = int(port.NodePort)
+		}
+	}
+
+	container := k.container(kubeService.ObjectMeta, "service")
+
+	services := []models.Service{}
+	for _, service := range k.Parser.Services(container) {
+		nodePort, ok := nodePorts[service.Port]
+		if !ok {
+			logrus.WithField("service", container.Name).Errorf("Fail to find the node port of port %d", service.Port)
+			continue
+		}
+		service.Port = nodePort
+		services = append(services, onNodes(service, addresses)...)
+	}
+
+	return services
+}
+
+// ingressServices returns the services of the hosts of an Ingress on every
+// node.
+func (k *Kubernetes) ingressServices(ingress networkingv1.Ingress, addresses []string) []models.Service {
+	container := k.container(ingress.ObjectMeta, "ingress")
+	rule := k.Parser.Label(labels.FrontendRuleLabel)
+
+	services := []models.Service{}
+	for _, ingressRule := range ingress.Spec.Rules {
+		if ingressRule.Host == "" {
+			continue
+		}
+
+		hostContainer := container
+		if _, ok := container.Labels[rule]; !ok {
+			hostContainer.Labels = map[string]string{rule: ingressRule.Host}
+			for key, value := range container.Labels {
+				hostContainer.Labels[key] = value
+			}
+		}
+
+		for _, service := range k.Parser.Services(hostContainer) {
+			services = append(services, onNodes(service, addresses)...)
+		}
+	}
+
+	return services
+}
+
+// container returns the metadata of a Kubernetes object the annotations can
+// refer to: its name, namespace as project and kind as service.
+func (k *Kubernetes) container(object metav1.ObjectMeta, kind string) labels.Container {
+	return labels.Container{
+		ID:      fmt.Sprintf("%s/%s/%s", kind, object.Namespace, object.Name),
+		Name:    object.Name,
+		Env:     map[string]string{},
+		Labels:  object.Annotations,
+		Project: object.Namespace,
+		Service: object.Name,
+	}
+}
+
+// nodeAddresses returns the sorted addresses of the ready and schedulable
+// nodes.
+func (k *Kubernetes) nodeAddresses(nodes []corev1.Node) []string {
+	addresses := []string{}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || !nodeReady(node) {
+			continue
+		}
+
+		address := node.Annotations[k.Parser.Label(labels.AddressLabel)]
+		for _, nodeAddress := range node.Status.Addresses {
+			if address == "" && nodeAddress.Type == corev1.NodeInternalIP {
+				address = nodeAddress.Address
+			}
+		}
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+func nodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func onNodes(service models.Service, addresses []string) []models.Service {
+	services := make([]models.Service, len(addresses))
+	for i, address := range addresses {
+		services[i] = service
+		services[i].Address = address
+	}
+	return services
+}
+
+// Watch polls the cluster and sends the services when they change. The API
+// server being unreachable is retried until stop is closed.
+func (k *Kubernetes) Watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	return poll(k, k.Interval, sets, stop)
+}
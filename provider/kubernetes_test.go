@@ -0,0 +1,174 @@
+package provider_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/models"
+	"github.com/thbkrkr/iplb-docker/provider"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func node(name string, ready bool, internalIP string, annotations map[string]string) *corev1.Node {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}},
+			Addresses:  []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: internalIP}},
+		},
+	}
+}
+
+func kubeService(name string, kind corev1.ServiceType, port int32, nodePort int32, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop", Annotations: annotations},
+		Spec: corev1.ServiceSpec{
+			Type:  kind,
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: port, NodePort: nodePort}},
+		},
+	}
+}
+
+func cluster() *fake.Clientset {
+	unschedulable := node("node-4", true, "10.0.0.4", nil)
+	unschedulable.Spec.Unschedulable = true
+
+	return fake.NewSimpleClientset(
+		node("node-1", true, "10.0.0.1", nil),
+		node("node-2", true, "10.0.0.2", map[string]string{"iplb.address": "192.168.0.2"}),
+		node("node-3", false, "10.0.0.3", nil),
+		unschedulable,
+		kubeService("web", corev1.ServiceTypeNodePort, 80, 30080, map[string]string{
+			"iplb.version":       "1",
+			"iplb.port":          "80",
+			"iplb.frontend.rule": "web.example.com",
+		}),
+		kubeService("db", corev1.ServiceTypeClusterIP, 5432, 0, map[string]string{
+			"iplb.version":       "1",
+			"iplb.port":          "5432",
+			"iplb.frontend.rule": "db.example.com",
+		}),
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: "front", Namespace: "shop", Annotations: map[string]string{
+				"iplb.version": "1",
+				"iplb.port":    "30443",
+			}},
+			Spec: networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{
+				{Host: "shop.example.com"},
+				{},
+			}},
+		},
+	)
+}
+
+func newKubernetes(t *testing.T, client *fake.Clientset) *provider.Kubernetes {
+	parser, err := labels.NewParser("iplb", "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.NewKubernetes(client, parser, "", 50*time.Millisecond)
+}
+
+func TestKubernetesList(t *testing.T) {
+	kube := newKubernetes(t, cluster())
+
+	services, err := kube.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []models.Service{
+		{Backend: "shop_web", Frontend: "web.example.com", Address: "10.0.0.1", Port: 30080},
+		{Backend: "shop_web", Frontend: "web.example.com", Address: "192.168.0.2", Port: 30080},
+		{Backend: "shop_front", Frontend: "shop.example.com", Address: "10.0.0.1", Port: 30443},
+		{Backend: "shop_front", Frontend: "shop.example.com", Address: "192.168.0.2", Port: 30443},
+	}
+	if len(services) != len(expected) {
+		t.Fatalf("expected %d services, got %+v", len(expected), services)
+	}
+	for i, service := range services {
+		if service.Backend != expected[i].Backend || service.Frontend != expected[i].Frontend ||
+			service.Address != expected[i].Address || service.Port != expected[i].Port {
+			t.Errorf("expected %+v, got %+v", expected[i], service)
+		}
+	}
+	if status := kube.Status(); !status.Connected {
+		t.Errorf("expected the provider to be connected, got %+v", status)
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+	client := cluster()
+	kube := newKubernetes(t, client)
+
+	// The API server is down at first
+	var lock sync.Mutex
+	failures := 1
+	client.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	sets := make(chan provider.ServiceSet)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- kube.Watch(sets, stop) }()
+
+	next := func() provider.ServiceSet {
+		t.Helper()
+		select {
+		case set := <-sets:
+			return set
+		case err := <-done:
+			t.Fatalf("expected the provider to keep watching, stopped with %v", err)
+		case <-time.After(timeout):
+			t.Fatal("timeout waiting for the services")
+		}
+		return provider.ServiceSet{}
+	}
+
+	set := next()
+	if set.Provider != "kubernetes" || len(set.Services) != 4 {
+		t.Errorf("expected the 4 services once the API server is up, got %+v", set)
+	}
+	if status := kube.Status(); !status.Connected {
+		t.Errorf("expected the provider to be connected again, got %+v", status)
+	}
+
+	_, err := client.CoreV1().Services("shop").Create(context.Background(),
+		kubeService("api", corev1.ServiceTypeLoadBalancer, 8080, 30081, map[string]string{
+			"iplb.version":       "1",
+			"iplb.port":          "8080",
+			"iplb.frontend.rule": "api.example.com",
+		}), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set = next()
+	if len(set.Services) != 6 {
+		t.Errorf("expected the services of the new Service, got %+v", set)
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("expected the provider to stop without error, got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package provider
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// ErrNotFound is returned for an unknown manual service.
+var ErrNotFound = errors.New("service not found")
+
+// InvalidServiceError is returned for a manual service rejected by the
+// validation of its labels.
+type InvalidServiceError struct {
+	Err error
+}
+
+func (e *InvalidServiceError) Error() string {
+	return e.Err.Error()
+}
+
+// Manual holds the services registered through the HTTP API, for the
+// processes that are not containers, persisted in a JSON file. Like in the
+// services file, their labels are the ones a container would have and are
+// validated the same way.
+type Manual struct {
+	Path   string
+	Parser *labels.Parser
+
+	connectivity
+	entries map[string]ManualService
+	changes chan struct{}
+	lock    sync.Mutex
+}
+
+// ManualService is a service registered through the HTTP API. Its address is
+// optional and defaults to the host of the agent.
+type ManualService struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// NewManual loads the services persisted in the file, if any. The directory
+// of the file must exist.
+func NewManual(path string, parser *labels.Parser) (*Manual, error) {
+	m := &Manual{
+		Path:    path,
+		Parser:  parser,
+		entries: map[string]ManualService{},
+		changes: make(chan struct{}, 1),
+	}
+
+	// Fail now rather than on the first registered service
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("invalid services store %s: its directory does not exist", path)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ManualService
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("invalid services store %s: %s", path, err)
+	}
+	for _, entry := range entries {
+		m.entries[entry.ID] = entry
+	}
+
+	return m, nil
+}
+
+func (m *Manual) Name() string {
+	return "api"
+}
+
+func (m *Manual) List() ([]models.Service, error) {
+	m.setStatus(m.Name(), nil)
+
+	services := []models.Service{}
+	for _, entry := range m.All() {
+		entryServices, err := m.services(entry)
+		if err != nil {
+			logrus.WithError(err).WithField("service", entry.Name).Error("Skip invalid manual service")
+			continue
+		}
+		services = append(services, entryServices...)
+	}
+
+	return services, nil
+}
+
+// Watch sends the services each time one is added, updated or deleted.
+func (m *Manual) Watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-m.changes:
+		case <-stop:
+			return nil
+		}
+
+		services, err := m.List()
+		if err != nil {
+			return err
+		}
+		sets <- ServiceSet{Provider: m.Name(), Services: services}
+	}
+}
+
+// All returns the manual services sorted by name.
+func (m *Manual) All() []ManualService {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := make([]ManualService, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries
+}
+
+// Add validates and stores a new service, returned with its ID.
+func (m *Manual) Add(entry ManualService) (ManualService, error) {
+	ID := make([]byte, 8)
+	if _, err := rand.Read(ID); err != nil {
+		return entry, err
+	}
+	entry.ID = hex.EncodeToString(ID)
+
+	return entry, m.put(entry, false)
+}
+
+// Update validates and replaces a stored service.
+func (m *Manual) Update(ID string, entry ManualService) (ManualService, error) {
+	entry.ID = ID
+	return entry, m.put(entry, true)
+}
+
+// Delete removes a stored service.
+func (m *Manual) Delete(ID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry, ok := m.entries[ID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(m.entries, ID)
+	if err := m.save(); err != nil {
+		m.entries[ID] = entry
+		return err
+	}
+
+	m.changed()
+	return nil
+}
+
+func (m *Manual) put(entry ManualService, exists bool) error {
+	if _, err := m.services(entry); err != nil {
+		return &InvalidServiceError{err}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	previous, ok := m.entries[entry.ID]
+	if ok != exists {
+		return ErrNotFound
+	}
+	for _, other := range m.entries {
+		if other.Name == entry.Name && other.ID != entry.ID {
+			return &InvalidServiceError{fmt.Errorf("duplicated service %s", entry.Name)}
+		}
+	}
+
+	m.entries[entry.ID] = entry
+	if err := m.save(); err != nil {
+		if exists {
+			m.entries[entry.ID] = previous
+		} else {
+			delete(m.entries, entry.ID)
+		}
+		return err
+	}
+
+	m.changed()
+	return nil
+}
+
+// services validates a manual service and returns the services of its
+// labels.
+func (m *Manual) services(entry ManualService) ([]models.Service, error) {
+	if entry.Name == "" {
+		return nil, fmt.Errorf("service without name")
+	}
+	if entry.Address != "" && net.ParseIP(entry.Address) == nil {
+		return nil, fmt.Errorf("invalid address %s for service %s", entry.Address, entry.Name)
+	}
+
+	container := labels.Container{
+		ID:     "api:" + entry.ID,
+		Name:   entry.Name,
+		Env:    entry.Env,
+		Labels: entry.Labels,
+	}
+	if container.Env == nil {
+		container.Env = map[string]string{}
+	}
+
+	services, err := m.Parser.ParseServices(container)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no exposed port in the labels of service %s", entry.Name)
+	}
+	for i := range services {
+		services[i].Address = entry.Address
+	}
+
+	return services, nil
+}
+
+// save writes the services through a temporary file.
+func (m *Manual) save() error {
+	entries := make([]ManualService, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(m.Path), ".services")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (m *Manual) changed() {
+	select {
+	case m.changes <- struct{}{}:
+	default:
+	}
+}
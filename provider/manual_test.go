@@ -0,0 +1,103 @@
+package provider_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/provider"
+)
+
+func newManual(t *testing.T, path string) *provider.Manual {
+	parser, err := labels.NewParser("iplb", "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manual, err := provider.NewManual(path, parser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manual
+}
+
+func grafana() provider.ManualService {
+	return provider.ManualService{
+		Name:    "grafana",
+		Address: "10.0.0.12",
+		Labels: map[string]string{
+			"iplb.port":          "3000",
+			"iplb.backend":       "grafana",
+			"iplb.frontend.rule": "grafana.example.com",
+		},
+	}
+}
+
+func TestManualPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	manual := newManual(t, path)
+
+	entry, err := manual.Add(grafana())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Labels["iplb.weight"] = "10"
+	if _, err := manual.Update(entry.ID, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := newManual(t, path).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Address != "10.0.0.12" || services[0].Weight != 10 {
+		t.Fatalf("expected the updated service to be loaded again, got %+v", services)
+	}
+
+	if err := manual.Delete(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if services, _ := newManual(t, path).List(); len(services) != 0 {
+		t.Errorf("expected the service to be deleted, got %+v", services)
+	}
+	if err := manual.Delete(entry.ID); err != provider.ErrNotFound {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestManualValidates(t *testing.T) {
+	manual := newManual(t, filepath.Join(t.TempDir(), "services.json"))
+	if _, err := manual.Add(grafana()); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]func(*provider.ManualService){
+		"duplicated name": func(entry *provider.ManualService) {},
+		"invalid address": func(entry *provider.ManualService) { entry.Address = "nowhere" },
+		"invalid weight":  func(entry *provider.ManualService) { entry.Labels["iplb.weight"] = "1000" },
+		"invalid probe":   func(entry *provider.ManualService) { entry.Labels["iplb.probe.type"] = "ping" },
+		"without port":    func(entry *provider.ManualService) { delete(entry.Labels, "iplb.port") },
+	}
+	for name, change := range invalid {
+		entry := grafana()
+		if name != "duplicated name" {
+			entry.Name = "other"
+		}
+		change(&entry)
+
+		_, err := manual.Add(entry)
+		if _, ok := err.(*provider.InvalidServiceError); !ok {
+			t.Errorf("%s: expected an invalid service error, got %v", name, err)
+		}
+	}
+}
+
+func TestManualRequiresDirectory(t *testing.T) {
+	parser, err := labels.NewParser("iplb", "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "data", "services.json")
+	if _, err := provider.NewManual(path, parser); err == nil {
+		t.Errorf("expected a store without directory to be refused")
+	}
+}
@@ -0,0 +1,208 @@
+package provider
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/thbkrkr/iplb-docker/metrics"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+// Provider discovers the services to register from a source like the Docker
+// daemon or a file.
+type Provider interface {
+	// Name identifies the provider. It is the origin of its services.
+	Name() string
+	// List returns the current services of the provider.
+	List() ([]models.Service, error)
+	// Watch sends all the services of the provider each time they change,
+	// until stop is closed or the source fails.
+	Watch(sets chan<- ServiceSet, stop <-chan struct{}) error
+	// Status returns the connectivity of the provider to its source.
+	Status() Status
+}
+
+// Status is the connectivity of a provider to its source since its last
+// change. A stopped provider no longer watches its source.
+type Status struct {
+	Provider  string    `json:"provider"`
+	Connected bool      `json:"connected"`
+	Stopped   bool      `json:"stopped,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Supervised is a provider reporting the error stopping its Watch as a
+// stopped status, for the agent to be restarted.
+type Supervised struct {
+	Provider
+
+	err   error
+	since time.Time
+	lock  sync.Mutex
+}
+
+func Supervise(p Provider) *Supervised {
+	return &Supervised{Provider: p}
+}
+
+func (s *Supervised) Watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	err := s.Provider.Watch(sets, stop)
+	if err != nil {
+		s.lock.Lock()
+		s.err = err
+		s.since = time.Now()
+		s.lock.Unlock()
+	}
+	return err
+}
+
+func (s *Supervised) Status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		return s.Provider.Status()
+	}
+	return Status{Provider: s.Name(), Stopped: true, Error: "stopped watching: " + s.err.Error(), Since: s.since}
+}
+
+// connectivity records the status of a provider for the providers embedding
+// it.
+type connectivity struct {
+	status Status
+	lock   sync.Mutex
+}
+
+func (c *connectivity) setStatus(provider string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	connected := err == nil
+	if c.status.Since.IsZero() || c.status.Connected != connected {
+		c.status.Since = time.Now()
+	}
+	c.status.Provider = provider
+	c.status.Connected = connected
+	c.status.Error = ""
+	if err != nil {
+		c.status.Error = err.Error()
+	}
+}
+
+func (c *connectivity) Status() Status {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.status
+}
+
+// minRetryDelay is the delay before listing again the services of a polled
+// provider after a failure, doubled at each new failure up to its interval.
+const minRetryDelay = time.Second
+
+// poll lists the services of a provider every interval and sends them when
+// they change, starting with the first list. A failed list is retried with a
+// backoff, its error being reported by the status of the provider meanwhile.
+func poll(p Provider, interval time.Duration, sets chan<- ServiceSet, stop <-chan struct{}) error {
+	var last []models.Service
+	listed := false
+	delay := time.Duration(0)
+	retry := time.Duration(0)
+
+	for {
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return nil
+		}
+
+		services, err := p.List()
+		if err != nil {
+			retry = backoff(retry, interval)
+			delay = retry
+			logrus.WithError(err).WithField("provider", p.Name()).WithField("retry", delay).Error("Fail to list services")
+			metrics.ProviderRetries.WithLabelValues(p.Name()).Inc()
+			continue
+		}
+		delay = interval
+		retry = 0
+		if listed && reflect.DeepEqual(services, last) {
+			continue
+		}
+
+		last = services
+		listed = true
+		select {
+		case sets <- ServiceSet{Provider: p.Name(), Services: services}:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// backoff returns the delay of the retry after the given one, from
+// minRetryDelay up to max.
+func backoff(delay time.Duration, max time.Duration) time.Duration {
+	delay *= 2
+	if delay < minRetryDelay {
+		delay = minRetryDelay
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// ServiceSet is the complete list of the services of a provider.
+type ServiceSet struct {
+	Provider string
+	Services []models.Service
+}
+
+// Registry merges the services of several providers.
+type Registry struct {
+	sets map[string][]models.Service
+	lock sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sets: map[string][]models.Service{}}
+}
+
+// Set replaces the services of a provider, tagged with its name as origin.
+func (r *Registry) Set(set ServiceSet) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	services := make([]models.Service, len(set.Services))
+	for i, service := range set.Services {
+		service.Origin = set.Provider
+		services[i] = service
+	}
+	r.sets[set.Provider] = services
+	metrics.Services.WithLabelValues(set.Provider).Set(float64(len(services)))
+}
+
+// Services returns the services of all the providers, sorted by provider to
+// keep the sync order stable.
+func (r *Registry) Services() []models.Service {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.sets))
+	for name := range r.sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	services := []models.Service{}
+	for _, name := range names {
+		services = append(services, r.sets[name]...)
+	}
+
+	return services
+}
@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/models"
+)
+
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+// Swarm reads the services from the labels of the Swarm services, given by
+// deploy.labels in a stack file, and registers each of their running tasks
+// on the address of its node. It must be connected to a manager and only one
+// agent is needed for the whole cluster.
+//
+// The port label is the target port of the service: when it is published,
+// the links use the published port. The address of a node can be overridden
+// by the address label of the prefix on the node, like iplb.address.
+type Swarm struct {
+	Client   *dockerapi.Client
+	Parser   *labels.Parser
+	Interval time.Duration
+
+	connectivity
+	httpClient *http.Client
+	baseURL    string
+}
+
+type swarmService struct {
+	ID   string `json:"ID"`
+	Spec struct {
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Spec"`
+	Endpoint struct {
+		Ports []struct {
+			Protocol      string `json:"Protocol"`
+			TargetPort    int    `json:"TargetPort"`
+			PublishedPort int    `json:"PublishedPort"`
+		} `json:"Ports"`
+	} `json:"Endpoint"`
+}
+
+type swarmTask struct {
+	ID        string `json:"ID"`
+	ServiceID string `json:"ServiceID"`
+	NodeID    string `json:"NodeID"`
+	Slot      int    `json:"Slot"`
+	Status    struct {
+		State string `json:"State"`
+	} `json:"Status"`
+}
+
+type swarmNode struct {
+	ID   string `json:"ID"`
+	Spec struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Spec"`
+	Status struct {
+		State string `json:"State"`
+		Addr  string `json:"Addr"`
+	} `json:"Status"`
+}
+
+func NewSwarm(client *dockerapi.Client, parser *labels.Parser, interval time.Duration) (*Swarm, error) {
+	endpoint, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Swarm{Client: client, Parser: parser, Interval: interval}
+	switch endpoint.Scheme {
+	case "unix":
+		socketPath := endpoint.Path
+		s.httpClient = &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return client.Dialer.Dial("unix", socketPath)
+			},
+		}}
+		s.baseURL = "http://unix.sock"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if client.TLSConfig != nil {
+			scheme = "https"
+		}
+		s.httpClient = client.HTTPClient
+		s.baseURL = scheme + "://" + endpoint.Host
+	default:
+		return nil, fmt.Errorf("unsupported Docker endpoint %s", client.Endpoint())
+	}
+
+	return s, nil
+}
+
+func (s *Swarm) Name() string {
+	return "swarm"
+}
+
+func (s *Swarm) List() ([]models.Service, error) {
+	services, err := s.list()
+	s.setStatus(s.Name(), err)
+	return services, err
+}
+
+func (s *Swarm) list() ([]models.Service, error) {
+	var services []swarmService
+	if err := s.get("/services", &services); err != nil {
+		return nil, err
+	}
+
+	var tasks []swarmTask
+	if err := s.get("/tasks?filters="+url.QueryEscape(`{"desired-state":["running"]}`), &tasks); err != nil {
+		return nil, err
+	}
+
+	var nodes []swarmNode
+	if err := s.get("/nodes", &nodes); err != nil {
+		return nil, err
+	}
+
+	addresses := map[string]string{}
+	for _, node := range nodes {
+		address := node.Spec.Labels[s.Parser.Label(labels.AddressLabel)]
+		if address == "" {
+			address = node.Status.Addr
+		}
+		addresses[node.ID] = address
+	}
+
+	tasksByService := map[string][]swarmTask{}
+	for _, task := range tasks {
+		if task.Status.State == "running" {
+			tasksByService[task.ServiceID] = append(tasksByService[task.ServiceID], task)
+		}
+	}
+
+	all := []models.Service{}
+	seen := map[string]bool{}
+	for _, service := range services {
+		published := map[int]int{}
+		for _, port := range service.Endpoint.Ports {
+			if port.Protocol == "tcp" && port.PublishedPort != 0 {
+				published[port.TargetPort] = port.PublishedPort
+			}
+		}
+
+		for _, task := range tasksByService[service.ID] {
+			address, ok := addresses[task.NodeID]
+			if !ok || address == "" {
+				logrus.WithField("task", task.ID).Warn("Skip task on a node without address")
+				continue
+			}
+
+			container := labels.Container{
+				ID:      task.ID,
+				Name:    service.Spec.Name + "." + strconv.Itoa(task.Slot),
+				Env:     map[string]string{},
+				Labels:  service.Spec.Labels,
+				Project: service.Spec.Labels[stackNamespaceLabel],
+				Service: service.Spec.Name,
+			}
+
+			for _, taskService := range s.Parser.Services(container) {
+				if port, ok := published[taskService.Port]; ok {
+					taskService.Port = port
+				}
+				taskService.Address = address
+
+				// Tasks of a service on the same node share the same link
+				key := fmt.Sprintf("%s/%s/%s:%d", service.ID, taskService.Name, address, taskService.Port)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				all = append(all, taskService)
+			}
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Container < all[j].Container
+	})
+
+	return all, nil
+}
+
+// Watch polls the manager since tasks are rescheduled across nodes, and
+// sends the services when they change. The manager being unreachable is
+// retried until stop is closed.
+func (s *Swarm) Watch(sets chan<- ServiceSet, stop <-chan struct{}) error {
+	return poll(s, s.Interval, sets, stop)
+}
+
+func (s *Swarm) get(path string, out interface{}) error {
+	resp, err := s.httpClient.Get(s.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker API %s returned %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,208 @@
+package provider_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/thbkrkr/iplb-docker/labels"
+	"github.com/thbkrkr/iplb-docker/models"
+	"github.com/thbkrkr/iplb-docker/provider"
+)
+
+// manager is a fake Swarm manager answering the services, tasks and nodes of
+// the raw Docker API.
+type manager struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	services []interface{}
+	tasks    []interface{}
+	nodes    []interface{}
+	failures int
+}
+
+func newManager(t *testing.T) *manager {
+	m := &manager{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		if m.failures > 0 {
+			m.failures--
+			http.Error(w, "manager unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var response interface{}
+		switch r.URL.Path {
+		case "/services":
+			response = m.services
+		case "/tasks":
+			response = m.tasks
+		case "/nodes":
+			response = m.nodes
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func swarmService(ID string, name string, serviceLabels map[string]string, targetPort int, publishedPort int) map[string]interface{} {
+	service := map[string]interface{}{
+		"ID":   ID,
+		"Spec": map[string]interface{}{"Name": name, "Labels": serviceLabels},
+	}
+	if publishedPort != 0 {
+		service["Endpoint"] = map[string]interface{}{"Ports": []interface{}{
+			map[string]interface{}{"Protocol": "tcp", "TargetPort": targetPort, "PublishedPort": publishedPort},
+		}}
+	}
+	return service
+}
+
+func swarmTask(ID string, serviceID string, nodeID string, slot int, state string) map[string]interface{} {
+	return map[string]interface{}{
+		"ID": ID, "ServiceID": serviceID, "NodeID": nodeID, "Slot": slot,
+		"Status": map[string]interface{}{"State": state},
+	}
+}
+
+func swarmNode(ID string, addr string, nodeLabels map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"ID":     ID,
+		"Spec":   map[string]interface{}{"Labels": nodeLabels},
+		"Status": map[string]interface{}{"State": "ready", "Addr": addr},
+	}
+}
+
+func stack(m *manager) {
+	web := map[string]string{
+		"com.docker.stack.namespace": "shop",
+		"iplb.port":                  "80",
+		"iplb.backend":               "shop_web",
+		"iplb.frontend.rule":         "web.example.com",
+	}
+	api := map[string]string{
+		"iplb.port":          "8080",
+		"iplb.backend":       "shop_api",
+		"iplb.frontend.rule": "api.example.com",
+	}
+	m.services = []interface{}{
+		swarmService("web", "shop_web", web, 80, 0),
+		swarmService("api", "shop_api", api, 8080, 30080),
+		swarmService("db", "shop_db", map[string]string{}, 0, 0),
+	}
+	m.tasks = []interface{}{
+		swarmTask("web-1", "web", "node-1", 1, "running"),
+		swarmTask("web-2", "web", "node-2", 2, "running"),
+		swarmTask("web-3", "web", "node-2", 3, "starting"),
+		swarmTask("web-4", "web", "node-3", 4, "running"),
+		swarmTask("api-1", "api", "node-1", 1, "running"),
+		swarmTask("api-2", "api", "node-1", 2, "running"),
+		swarmTask("db-1", "db", "node-1", 1, "running"),
+	}
+	m.nodes = []interface{}{
+		swarmNode("node-1", "10.0.0.1", nil),
+		swarmNode("node-2", "10.0.0.2", map[string]string{"iplb.address": "192.168.0.2"}),
+		swarmNode("node-3", "", nil),
+	}
+}
+
+func newSwarm(t *testing.T, m *manager) *provider.Swarm {
+	client, err := dockerapi.NewClient(m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := labels.NewParser("iplb", "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	swarm, err := provider.NewSwarm(client, parser, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return swarm
+}
+
+func TestSwarmList(t *testing.T) {
+	m := newManager(t)
+	stack(m)
+	swarm := newSwarm(t, m)
+
+	services, err := swarm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The task starting and the task on a node without address are skipped,
+	// the tasks of api on node-1 share a link on the published port
+	expected := []models.Service{
+		{Backend: "shop_api", Address: "10.0.0.1", Port: 30080},
+		{Backend: "shop_web", Address: "10.0.0.1", Port: 80},
+		{Backend: "shop_web", Address: "192.168.0.2", Port: 80},
+	}
+	if len(services) != len(expected) {
+		t.Fatalf("expected %d services, got %+v", len(expected), services)
+	}
+	for i, service := range services {
+		if service.Backend != expected[i].Backend || service.Address != expected[i].Address || service.Port != expected[i].Port {
+			t.Errorf("expected %+v, got %+v", expected[i], service)
+		}
+	}
+	if services[1].Project != "shop" || services[1].Container != "shop_web.1" {
+		t.Errorf("expected the task to be named after its service and slot, got %+v", services[1])
+	}
+	if status := swarm.Status(); !status.Connected {
+		t.Errorf("expected the provider to be connected, got %+v", status)
+	}
+}
+
+func TestSwarmWatch(t *testing.T) {
+	m := newManager(t)
+	stack(m)
+	m.failures = 1
+	swarm := newSwarm(t, m)
+
+	sets := make(chan provider.ServiceSet)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- swarm.Watch(sets, stop) }()
+
+	next := func() provider.ServiceSet {
+		t.Helper()
+		select {
+		case set := <-sets:
+			return set
+		case err := <-done:
+			t.Fatalf("expected the provider to keep watching, stopped with %v", err)
+		case <-time.After(timeout):
+			t.Fatal("timeout waiting for the services")
+		}
+		return provider.ServiceSet{}
+	}
+
+	if set := next(); set.Provider != "swarm" || len(set.Services) != 3 {
+		t.Errorf("expected the 3 services once the manager is up, got %+v", set)
+	}
+
+	// node-3 gets an address for web-4
+	m.lock.Lock()
+	m.nodes[2] = swarmNode("node-3", "10.0.0.3", nil)
+	m.lock.Unlock()
+	if set := next(); len(set.Services) != 4 || set.Services[3].Address != "10.0.0.3" {
+		t.Errorf("expected web-4 to be registered on node-3, got %+v", set)
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("expected the provider to stop without error, got %v", err)
+	}
+}